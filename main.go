@@ -38,7 +38,11 @@ func main() {
 	log.Debugf("Config: %v", c)
 
 	// create the handler object
-	gh = handler.NewHandler(&c)
+	gh, err = handler.NewHandler(&c)
+	if err != nil {
+		fmt.Printf("failed to create devices: %v\n", err)
+		os.Exit(1)
+	}
 
 	// create the server object
 	server, err = modbus.NewServer(&modbus.ServerConfiguration{
@@ -60,7 +64,11 @@ func main() {
 	}
 	defer server.Stop()
 
-	gh.Init()
+	err = gh.Init()
+	if err != nil {
+		fmt.Printf("failed to initialize devices: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Start the main ticker
 	gh.Ticker()
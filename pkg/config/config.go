@@ -15,21 +15,295 @@ type HVAC struct {
 	IdleCurrent    float32 `toml:"idle_current"`
 	MaxFanSpeed    uint16  `toml:"max_fan_speed"`
 	RoomTempOffset float32 `toml:"room_temp_offset"`
+	NominalVoltage float32 `toml:"nominal_voltage"`
+	Mode           string  `toml:"mode"`
+	Setpoint       float32 `toml:"setpoint"`
+	Deadband       float32 `toml:"deadband"`
+
+	ThermalMass     float32 `toml:"thermal_mass"`
+	EnvelopeUA      float32 `toml:"envelope_ua"`
+	InternalGains   float32 `toml:"internal_gains"`
+	FanPower        float32 `toml:"fan_power"`
+	CoolingCapacity float32 `toml:"cooling_capacity"`
+	COP             float32 `toml:"cop"`
+	HeaterPower     float32 `toml:"heater_power"`
+
+	RoomVolume     float32  `toml:"room_volume"`
+	Infiltration   float32  `toml:"infiltration"`
+	OutdoorAirflow float32  `toml:"outdoor_airflow"`
+	OutdoorCO2     float32  `toml:"outdoor_co2"`
+	Occupancy      []uint16 `toml:"occupancy"`
+
+	FilterClog            float32 `toml:"filter_clog"`
+	FilterClogRate        float32 `toml:"filter_clog_rate"`
+	BearingWear           float32 `toml:"bearing_wear"`
+	BearingWearRate       float32 `toml:"bearing_wear_rate"`
+	CompressorFailed      bool    `toml:"compressor_failed"`
+	CompressorFailureTime uint32  `toml:"compressor_failure_time"`
+
+	ZoneBase   uint16     `toml:"zone_base"`
+	ZoneStride uint16     `toml:"zone_stride"`
+	Zones      []HVACZone `toml:"zone"`
+}
+
+type HVACZone struct {
+	Name          string  `toml:"name"`
+	ThermalMass   float32 `toml:"thermal_mass"`
+	EnvelopeUA    float32 `toml:"envelope_ua"`
+	InternalGains float32 `toml:"internal_gains"`
+	Setpoint      float32 `toml:"setpoint"`
+}
+
+type PulseChannel struct {
+	Name    string    `toml:"name"`
+	Model   string    `toml:"model"`
+	Weight  float32   `toml:"weight"`
+	Chance  float32   `toml:"chance"`
+	Min     uint32    `toml:"min"`
+	Max     uint32    `toml:"max"`
+	Rate    float32   `toml:"rate"`
+	Profile []float32 `toml:"profile"`
+	Width   uint8     `toml:"width"`
+	Preset  uint64    `toml:"preset"`
 }
 
 type PulseCounter struct {
-	Enabled           bool    `toml:"enabled"`
-	ChanceToIncrement float32 `toml:"chance_to_increment"`
+	Enabled           bool           `toml:"enabled"`
+	ChanceToIncrement float32        `toml:"chance_to_increment"`
+	Channels          []PulseChannel `toml:"channel"`
 }
 
 type WaterTank struct {
 	Enabled            bool   `toml:"enabled"`
+	Name               string `toml:"name"`    // only used by the additional water tanks
+	UnitId             uint8  `toml:"unit_id"` // only used by the additional water tanks
 	MaxTankCapacity    uint16 `toml:"max_tank_capacity"`
 	MaxWaterLevel      uint16 `toml:"max_water_level"`
 	MinWaterLevel      uint16 `toml:"min_water_level"`
 	MaxWaterLevelAlarm uint16 `toml:"max_water_level_alarm"`
 	DrainRate          uint16 `toml:"drain_rate"`
 	FillRate           uint16 `toml:"fill_rate"`
+	PumpPower          uint16 `toml:"pump_power"`
+	// the drain valve is an actuated valve with a positioner if its stroke time is set
+	DrainValveStrokeTime float32 `toml:"drain_valve_stroke_time"`
+}
+
+type Battery struct {
+	Enabled            bool    `toml:"enabled"`
+	Capacity           float32 `toml:"capacity"`
+	MaxChargePower     uint16  `toml:"max_charge_power"`
+	MaxDischargePower  uint16  `toml:"max_discharge_power"`
+	Efficiency         float32 `toml:"efficiency"`
+	NominalVoltage     float32 `toml:"nominal_voltage"`
+	InternalResistance float32 `toml:"internal_resistance"`
+	InitialSoC         uint16  `toml:"initial_soc"`
+	MinSoC             uint16  `toml:"min_soc"`
+	MaxSoC             uint16  `toml:"max_soc"`
+	MaxTemperature     float32 `toml:"max_temperature"`
+	CycleLife          uint16  `toml:"cycle_life"`
+}
+
+type Solar struct {
+	Enabled                bool    `toml:"enabled"`
+	Latitude               float64 `toml:"latitude"`
+	Longitude              float64 `toml:"longitude"`
+	RatedPower             float32 `toml:"rated_power"`
+	MaxACPower             float32 `toml:"max_ac_power"`
+	InverterEfficiency     float32 `toml:"inverter_efficiency"`
+	MPPVoltage             float32 `toml:"mpp_voltage"`
+	TemperatureCoefficient float32 `toml:"temperature_coefficient"`
+	ACVoltage              float32 `toml:"ac_voltage"`
+	ACFrequency            float32 `toml:"ac_frequency"`
+	Phases                 int     `toml:"phases"`
+	SunSpec                bool    `toml:"sunspec"`
+	SerialNumber           string  `toml:"serial_number"`
+}
+
+type WindTurbine struct {
+	Enabled      bool    `toml:"enabled"`
+	RatedPower   float32 `toml:"rated_power"`
+	CutInSpeed   float32 `toml:"cut_in_speed"`
+	RatedSpeed   float32 `toml:"rated_speed"`
+	CutOutSpeed  float32 `toml:"cut_out_speed"`
+	RestartSpeed float32 `toml:"restart_speed"`
+	RestartDelay uint16  `toml:"restart_delay"`
+	RatedRPM     float32 `toml:"rated_rpm"`
+	YawRate      float32 `toml:"yaw_rate"`
+}
+
+type EnergyMeter struct {
+	Enabled        bool     `toml:"enabled"`
+	NominalVoltage float32  `toml:"nominal_voltage"`
+	Frequency      float32  `toml:"frequency"`
+	BaseLoad       float32  `toml:"base_load"`
+	PowerFactor    float32  `toml:"power_factor"`
+	Sources        []string `toml:"sources"`
+	SunSpec        bool     `toml:"sunspec"`
+	SerialNumber   string   `toml:"serial_number"`
+}
+
+type Genset struct {
+	Enabled          bool    `toml:"enabled"`
+	RatedPower       float32 `toml:"rated_power"`
+	RatedRPM         float32 `toml:"rated_rpm"`
+	RatedVoltage     float32 `toml:"rated_voltage"`
+	RatedFrequency   float32 `toml:"rated_frequency"`
+	CrankTime        uint16  `toml:"crank_time"`
+	WarmupTime       uint16  `toml:"warmup_time"`
+	CooldownTime     uint16  `toml:"cooldown_time"`
+	FuelCapacity     float32 `toml:"fuel_capacity"`
+	FuelConsumption  float32 `toml:"fuel_consumption"`
+	InitialFuelLevel uint16  `toml:"initial_fuel_level"`
+}
+
+type Breaker struct {
+	Enabled             bool     `toml:"enabled"`
+	NominalVoltage      float32  `toml:"nominal_voltage"`
+	PickupCurrent       uint16   `toml:"pickup_current"`
+	TimeDial            float32  `toml:"time_dial"`
+	Curve               string   `toml:"curve"`
+	InstantaneousPickup uint16   `toml:"instantaneous_pickup"`
+	Sources             []string `toml:"sources"`
+}
+
+type Boiler struct {
+	Enabled           bool    `toml:"enabled"`
+	BurnerPower       float32 `toml:"burner_power"`
+	WaterCapacity     float32 `toml:"water_capacity"`
+	InitialWaterLevel uint16  `toml:"initial_water_level"`
+	FeedPumpFlow      float32 `toml:"feed_pump_flow"`
+	MaxSteamFlow      float32 `toml:"max_steam_flow"`
+	PressureSetpoint  float32 `toml:"pressure_setpoint"`
+	ReliefPressure    float32 `toml:"relief_pressure"`
+	HighPressureTrip  float32 `toml:"high_pressure_trip"`
+	LowWaterTrip      float32 `toml:"low_water_trip"`
+}
+
+type VFD struct {
+	Enabled          bool    `toml:"enabled"`
+	RatedPower       float32 `toml:"rated_power"`
+	RatedVoltage     float32 `toml:"rated_voltage"`
+	RatedCurrent     float32 `toml:"rated_current"`
+	RatedFrequency   float32 `toml:"rated_frequency"`
+	RatedSpeed       float32 `toml:"rated_speed"`
+	MaxFrequency     float32 `toml:"max_frequency"`
+	AccelTime        float32 `toml:"accel_time"`
+	DecelTime        float32 `toml:"decel_time"`
+	Inertia          float32 `toml:"inertia"`
+	LoadTorque       uint16  `toml:"load_torque"`
+	OvercurrentLimit uint16  `toml:"overcurrent_limit"`
+	MaxTemperature   float32 `toml:"max_temperature"`
+}
+
+type WaterTreatment struct {
+	Enabled               bool    `toml:"enabled"`
+	WaterTankOutflow      bool    `toml:"watertank_outflow"`
+	Flow                  float32 `toml:"flow"`
+	ContactVolume         float32 `toml:"contact_volume"`
+	RawPH                 float32 `toml:"raw_ph"`
+	Alkalinity            float32 `toml:"alkalinity"`
+	ChlorineConcentration float32 `toml:"chlorine_concentration"`
+	CausticConcentration  float32 `toml:"caustic_concentration"`
+	ChlorinePumpCapacity  float32 `toml:"chlorine_pump_capacity"`
+	CausticPumpCapacity   float32 `toml:"caustic_pump_capacity"`
+	ChlorineDose          float32 `toml:"chlorine_dose"`
+	CausticDose           float32 `toml:"caustic_dose"`
+	ChlorineLowAlarm      float32 `toml:"chlorine_low_alarm"`
+	ChlorineHighAlarm     float32 `toml:"chlorine_high_alarm"`
+	PHLowAlarm            float32 `toml:"ph_low_alarm"`
+	PHHighAlarm           float32 `toml:"ph_high_alarm"`
+}
+
+type TrafficSignal struct {
+	Enabled    bool   `toml:"enabled"`
+	MainGreen  uint16 `toml:"main_green"`
+	MainYellow uint16 `toml:"main_yellow"`
+	AllRed     uint16 `toml:"all_red"`
+	SideGreen  uint16 `toml:"side_green"`
+	SideYellow uint16 `toml:"side_yellow"`
+}
+
+type Valve struct {
+	Enabled         bool    `toml:"enabled"`
+	StrokeTime      float32 `toml:"stroke_time"`
+	InitialPosition uint16  `toml:"initial_position"`
+	FailureMode     string  `toml:"failure_mode"`
+}
+
+type HydraulicTank struct {
+	Name         string  `toml:"name"`
+	Elevation    float32 `toml:"elevation"`
+	Area         float32 `toml:"area"`
+	Height       float32 `toml:"height"`
+	InitialLevel float32 `toml:"initial_level"`
+	LowAlarm     float32 `toml:"low_alarm"`
+	HighAlarm    float32 `toml:"high_alarm"`
+	Demand       float32 `toml:"demand"`
+}
+
+type HydraulicPipe struct {
+	Name                string  `toml:"name"`
+	From                string  `toml:"from"`
+	To                  string  `toml:"to"`
+	Length              float32 `toml:"length"`
+	Diameter            float32 `toml:"diameter"`
+	Roughness           float32 `toml:"roughness"`
+	MinorLoss           float32 `toml:"minor_loss"`
+	PumpShutoffHead     float32 `toml:"pump_shutoff_head"`
+	PumpMaxFlow         float32 `toml:"pump_max_flow"`
+	PumpEfficiency      float32 `toml:"pump_efficiency"`
+	ValveCv             float32 `toml:"valve_cv"`
+	ValveCharacteristic string  `toml:"valve_characteristic"`
+}
+
+type Hydraulics struct {
+	Enabled bool            `toml:"enabled"`
+	Tanks   []HydraulicTank `toml:"tank"`
+	Pipes   []HydraulicPipe `toml:"pipe"`
+}
+
+type PIDLoop struct {
+	Name         string  `toml:"name"`
+	Setpoint     float32 `toml:"setpoint"`
+	Kp           float32 `toml:"kp"`
+	Ki           float32 `toml:"ki"`
+	Kd           float32 `toml:"kd"`
+	OutputMin    float32 `toml:"output_min"`
+	OutputMax    float32 `toml:"output_max"`
+	Action       string  `toml:"action"`
+	Manual       bool    `toml:"manual"`
+	ManualOutput float32 `toml:"manual_output"`
+}
+
+type PID struct {
+	Enabled bool      `toml:"enabled"`
+	Loops   []PIDLoop `toml:"loop"`
+}
+
+// Link connects an output of a device to an input of another device, both written as "device.port"
+type Link struct {
+	From string `toml:"from"`
+	To   string `toml:"to"`
+}
+
+type Topology struct {
+	Links []Link `toml:"link"`
+}
+
+type ModbusClientMapping struct {
+	Type       string `toml:"type"` // coil, discrete_input, holding_register, input_register
+	RemoteAddr uint16 `toml:"remote_addr"`
+	LocalAddr  uint16 `toml:"local_addr"`
+	Quantity   uint16 `toml:"quantity"`
+}
+
+type ModbusClient struct {
+	Enabled      bool                  `toml:"enabled"`
+	URL          string                `toml:"url"`
+	UnitId       uint8                 `toml:"unit_id"`
+	PollInterval uint                  `toml:"poll_interval"`
+	Timeout      uint                  `toml:"timeout"`
+	Mappings     []ModbusClientMapping `toml:"mapping"`
 }
 
 type Config struct {
@@ -44,6 +318,22 @@ type Config struct {
 	HVAC           HVAC
 	PulseCounter   PulseCounter
 	WaterTank      WaterTank
+	ModbusClient   ModbusClient
+	Battery        Battery
+	Solar          Solar
+	WindTurbine    WindTurbine
+	EnergyMeter    EnergyMeter
+	Genset         Genset
+	Breaker        Breaker
+	Boiler         Boiler
+	VFD            VFD
+	WaterTreatment WaterTreatment
+	TrafficSignal  TrafficSignal
+	Hydraulics     Hydraulics
+	Valve          Valve
+	PID            PID
+	WaterTanks     []WaterTank
+	Topology       Topology
 }
 
 func (c *Config) MapLogLevel(level string) log.Level {
@@ -0,0 +1,423 @@
+package handler
+
+/*
+* This file contains the handler for the battery energy storage simulation.
+* The handler charges and discharges the battery according to the power
+* setpoints, taking the efficiency losses, the state of charge limits and
+* the pack temperature into account.
+ */
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	batteryRunReg  = 0 // false for idle, true for running
+	batteryModeReg = 1 // false for charge, true for discharge
+
+	// Discrete Inputs (Read-Only)
+	batteryFullReg     = 0
+	batteryEmptyReg    = 1
+	batteryOverTempReg = 2
+
+	// Holding Registers (Read/Write)
+	batteryChargeSetpointReg    = 100
+	batteryDischargeSetpointReg = 101
+	batteryOperatingModeReg     = 102 // idle, charge or discharge, mirrors the run and mode coils
+
+	// Input Registers (Read-Only)
+	batteryVoltageReg     = 100
+	batteryCurrentReg     = 102
+	batterySoCReg         = 104
+	batterySoHReg         = 106
+	batteryTemperatureReg = 108
+	batteryPowerReg       = 110
+	batteryEnergyReg      = 112
+)
+
+// Operating modes
+const (
+	batteryIdle      = 0
+	batteryCharge    = 1
+	batteryDischarge = 2
+)
+
+const (
+	// thermal mass and conductance to the ambient air per kWh of capacity
+	batteryHeatCapacity    = 7000 // J/K
+	batteryHeatConductance = 5    // W/K
+
+	// state of health lost over the configured cycle life
+	batteryEndOfLifeFade = 20 // %
+
+	// the pack temperature at which the power is cut when it is not configured
+	batteryDefaultMaxTemperature = 45 // C
+	// the power is derated over the last degrees below the max temperature
+	batteryDerating = 10 // C
+)
+
+type BatteryHandler struct {
+	Lock sync.RWMutex
+
+	coils          [10]bool
+	discreteInputs [10]bool
+
+	capacity           float32 // kWh
+	maxChargePower     uint16  // W
+	maxDischargePower  uint16  // W
+	efficiency         float32 // one-way efficiency, between 0 and 1
+	nominalVoltage     float32
+	internalResistance float32
+	minSoC             uint16 // Stop discharging when the state of charge reaches this value
+	maxSoC             uint16 // Stop charging when the state of charge reaches this value
+	maxTemperature     float32
+	cycleLife          uint16
+
+	chargeSetpoint    uint16 // W
+	dischargeSetpoint uint16 // W
+
+	energy             float64 // kWh
+	stateOfCharge      float32 // %
+	stateOfHealth      float64 // %
+	voltage            float32
+	current            float32 // positive when discharging
+	power              float32 // W, positive when discharging
+	temperature        float32
+	ambientTemperature float32
+}
+
+func NewBatteryHandler(config config.Battery) *BatteryHandler {
+	return &BatteryHandler{
+		capacity:           config.Capacity,
+		maxChargePower:     config.MaxChargePower,
+		maxDischargePower:  config.MaxDischargePower,
+		efficiency:         config.Efficiency,
+		nominalVoltage:     config.NominalVoltage,
+		internalResistance: config.InternalResistance,
+		stateOfCharge:      float32(config.InitialSoC),
+		minSoC:             config.MinSoC,
+		maxSoC:             config.MaxSoC,
+		maxTemperature:     config.MaxTemperature,
+		cycleLife:          config.CycleLife,
+	}
+}
+
+func (h *BatteryHandler) SetTemperature(temperature float32) {
+	h.Lock.Lock()
+	h.ambientTemperature = temperature
+	h.Lock.Unlock()
+}
+
+// Power returns the power flowing into the battery in W, negative when discharging
+func (h *BatteryHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return -h.power
+}
+
+// Output returns the value of the named topology output
+func (h *BatteryHandler) Output(port string) (float32, bool) {
+	switch port {
+	case "power":
+		return h.Power(), true
+	}
+	return 0, false
+}
+
+func (h *BatteryHandler) Init() error {
+	if h.capacity <= 0 {
+		return fmt.Errorf("battery capacity must be positive")
+	}
+	// the current is the power over the voltage
+	if h.nominalVoltage <= 0 {
+		return fmt.Errorf("battery nominal voltage must be positive")
+	}
+	if h.internalResistance < 0 {
+		return fmt.Errorf("battery internal resistance must not be negative")
+	}
+	// an unset max state of charge would leave the battery always full
+	if h.maxSoC == 0 {
+		h.maxSoC = 100
+	}
+	if h.minSoC >= h.maxSoC || h.maxSoC > 100 || h.stateOfCharge > 100 {
+		return fmt.Errorf("battery state of charge limits must be min < max <= 100, with an initial state of charge up to 100")
+	}
+	// an unset max temperature would leave the pack always over temperature
+	if h.maxTemperature == 0 {
+		h.maxTemperature = batteryDefaultMaxTemperature
+	}
+	if h.maxTemperature <= batteryDerating {
+		return fmt.Errorf("battery max temperature must be above %v C", batteryDerating)
+	}
+	if h.efficiency <= 0 || h.efficiency > 1 {
+		h.efficiency = 1
+	}
+	if h.cycleLife == 0 {
+		h.cycleLife = 5000
+	}
+
+	h.ambientTemperature = 25
+	h.temperature = h.ambientTemperature
+	h.stateOfHealth = 100
+	h.energy = float64(h.capacity) * float64(h.stateOfCharge) / 100
+	h.voltage = h.openCircuitVoltage()
+	h.chargeSetpoint = h.maxChargePower
+	h.dischargeSetpoint = h.maxDischargePower
+
+	h.coils[batteryRunReg] = false
+	h.coils[batteryModeReg] = false
+
+	return nil
+}
+
+// operatingMode returns the operating mode commanded by the run and mode coils
+func (h *BatteryHandler) operatingMode() uint16 {
+	switch {
+	case !h.coils[batteryRunReg]:
+		return batteryIdle
+	case h.coils[batteryModeReg]:
+		return batteryDischarge
+	}
+	return batteryCharge
+}
+
+// openCircuitVoltage follows the state of charge between 90% and 110% of the nominal voltage
+func (h *BatteryHandler) openCircuitVoltage() float32 {
+	return h.nominalVoltage * (0.9 + 0.2*h.stateOfCharge/100)
+}
+
+// derating returns the fraction of the requested power the pack accepts at its current temperature
+func (h *BatteryHandler) derating() float32 {
+	if h.temperature >= h.maxTemperature {
+		return 0
+	}
+	// reduce the power linearly over the last degrees
+	if h.temperature > h.maxTemperature-batteryDerating {
+		return (h.maxTemperature - h.temperature) / batteryDerating
+	}
+	return 1
+}
+
+func (h *BatteryHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	// the energy and the state of health are kept in float64 so the small
+	// increments of the one second tick are not lost
+	usableCapacity := float64(h.capacity) * h.stateOfHealth / 100
+
+	h.discreteInputs[batteryFullReg] = h.stateOfCharge >= float32(h.maxSoC)
+	h.discreteInputs[batteryEmptyReg] = h.stateOfCharge <= float32(h.minSoC)
+	h.discreteInputs[batteryOverTempReg] = h.temperature >= h.maxTemperature
+
+	var losses float32
+	var storedEnergy float32
+
+	log.Debugf("Battery Run: %v, Discharge Mode: %v", h.coils[batteryRunReg], h.coils[batteryModeReg])
+
+	h.power = 0
+	if h.coils[batteryRunReg] && !h.coils[batteryModeReg] && !h.discreteInputs[batteryFullReg] {
+		// charging
+		p := float32(min(h.chargeSetpoint, h.maxChargePower)) * h.derating()
+		storedEnergy = p * h.efficiency
+		losses = p - storedEnergy
+		h.power = -p
+	}
+
+	if h.coils[batteryRunReg] && h.coils[batteryModeReg] && !h.discreteInputs[batteryEmptyReg] {
+		// discharging
+		p := float32(min(h.dischargeSetpoint, h.maxDischargePower)) * h.derating()
+		storedEnergy = -p / h.efficiency
+		losses = -storedEnergy - p
+		h.power = p
+	}
+
+	// energy is integrated over the one second tick
+	h.energy += float64(storedEnergy) / 3600 / 1000
+	h.energy = max(0, min(h.energy, usableCapacity))
+	if usableCapacity > 0 {
+		h.stateOfCharge = float32(h.energy / usableCapacity * 100)
+	}
+	log.Debugf("Battery Power: %v, Energy: %v, SoC: %v", h.power, h.energy, h.stateOfCharge)
+
+	// cell fade is proportional to the energy throughput
+	fullCycles := math.Abs(float64(storedEnergy)) / 3600 / 1000 / (2 * float64(h.capacity))
+	h.stateOfHealth -= fullCycles / float64(h.cycleLife) * batteryEndOfLifeFade
+	log.Debugf("Battery SoH: %v", h.stateOfHealth)
+
+	ocv := h.openCircuitVoltage()
+	h.current = h.power / ocv
+	h.voltage = ocv - h.current*h.internalResistance
+
+	// the pack heats up with the conversion and resistive losses
+	// and cools down towards the ambient temperature
+	heat := losses + h.current*h.current*h.internalResistance
+	cooling := (h.temperature - h.ambientTemperature) * batteryHeatConductance * h.capacity
+	h.temperature += (heat - cooling) / (batteryHeatCapacity * h.capacity)
+	log.Debugf("Battery Voltage: %v, Current: %v, Temperature: %v", h.voltage, h.current, h.temperature)
+
+	return nil
+}
+
+func (h *BatteryHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *BatteryHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.discreteInputs) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		res = append(res, h.discreteInputs[int(req.Addr)+i])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *BatteryHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		switch regAddr {
+		case batteryChargeSetpointReg:
+			if req.IsWrite {
+				if req.Args[i] > h.maxChargePower {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.chargeSetpoint = req.Args[i]
+			}
+			res = append(res, h.chargeSetpoint)
+
+		case batteryDischargeSetpointReg:
+			if req.IsWrite {
+				if req.Args[i] > h.maxDischargePower {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.dischargeSetpoint = req.Args[i]
+			}
+			res = append(res, h.dischargeSetpoint)
+
+		case batteryOperatingModeReg:
+			// a single register for the clients that command the mode as a
+			// value, it reads and writes the run and mode coils
+			if req.IsWrite {
+				if req.Args[i] > batteryDischarge {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.coils[batteryRunReg] = req.Args[i] != batteryIdle
+				h.coils[batteryModeReg] = req.Args[i] == batteryDischarge
+			}
+			res = append(res, h.operatingMode())
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *BatteryHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case batteryVoltageReg:
+			res = append(res, uint16((math.Float32bits(h.voltage)>>16)&0xffff))
+		case batteryVoltageReg + 1:
+			res = append(res, uint16((math.Float32bits(h.voltage))&0xffff))
+
+		case batteryCurrentReg:
+			res = append(res, uint16((math.Float32bits(h.current)>>16)&0xffff))
+		case batteryCurrentReg + 1:
+			res = append(res, uint16((math.Float32bits(h.current))&0xffff))
+
+		case batterySoCReg:
+			res = append(res, uint16((math.Float32bits(h.stateOfCharge)>>16)&0xffff))
+		case batterySoCReg + 1:
+			res = append(res, uint16((math.Float32bits(h.stateOfCharge))&0xffff))
+
+		case batterySoHReg:
+			res = append(res, uint16((math.Float32bits(float32(h.stateOfHealth))>>16)&0xffff))
+		case batterySoHReg + 1:
+			res = append(res, uint16((math.Float32bits(float32(h.stateOfHealth)))&0xffff))
+
+		case batteryTemperatureReg:
+			res = append(res, uint16((math.Float32bits(h.temperature)>>16)&0xffff))
+		case batteryTemperatureReg + 1:
+			res = append(res, uint16((math.Float32bits(h.temperature))&0xffff))
+
+		case batteryPowerReg:
+			res = append(res, uint16((math.Float32bits(h.power)>>16)&0xffff))
+		case batteryPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.power))&0xffff))
+
+		case batteryEnergyReg:
+			res = append(res, uint16((math.Float32bits(float32(h.energy))>>16)&0xffff))
+		case batteryEnergyReg + 1:
+			res = append(res, uint16((math.Float32bits(float32(h.energy)))&0xffff))
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
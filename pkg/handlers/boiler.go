@@ -0,0 +1,413 @@
+package handler
+
+/*
+* This file contains the handler for the steam boiler simulation. The boiler
+* is modelled as a single lump of saturated water: the burner heats the water
+* and the steam pressure follows the saturation pressure of the water
+* temperature. Steam leaves through the steam valve and the relief valve,
+* and the feedwater pump makes up the water level. High pressure and low
+* water trips lock the burner out until they are reset.
+ */
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	boilerBurnerReg    = 0
+	boilerFeedPumpReg  = 1
+	boilerAutoModeReg  = 2 // the controller drives the burner and the feed pump
+	boilerTripResetReg = 3
+
+	// Discrete Inputs (Read-Only)
+	boilerFiringReg       = 0
+	boilerFeedRunningReg  = 1
+	boilerReliefOpenReg   = 2
+	boilerHighPressureReg = 3
+	boilerLowWaterReg     = 4
+	boilerLockoutReg      = 5
+
+	// Holding Registers (Read/Write)
+	boilerFiringRateReg       = 100 // %
+	boilerPressureSetpointReg = 101 // 0.1 bar
+	boilerSteamValveReg       = 102 // %
+
+	// Input Registers (Read-Only)
+	boilerWaterTempReg  = 100
+	boilerPressureReg   = 102 // bar, gauge
+	boilerLevelReg      = 104 // %
+	boilerSteamFlowReg  = 106 // kg/s
+	boilerFeedFlowReg   = 108 // kg/s
+	boilerReliefFlowReg = 110 // kg/s
+	boilerHeatInputReg  = 112 // kW
+)
+
+const (
+	waterSpecificHeat      = 4.186   // kJ/kg.K
+	atmosphericPressure    = 1.01325 // bar
+	boilerAmbient          = 20
+	boilerFeedwaterTemp    = 80
+	boilerBurnerEfficiency = 0.85
+	// heat lost through the shell per kW of burner power
+	boilerHeatLoss = 0.0001 // kW/K
+	// the relief valve reseats this fraction below its set pressure
+	reliefBlowdown = 0.07
+	// the relief valve is sized to pass the full steam production of the burner
+	reliefOversize = 1.2
+	// the burner cannot fire below its turndown
+	boilerMinFiringRate = 20 // %
+	// pressure band of the auto mode firing rate controller
+	boilerProportionalBand = 1 // bar
+	// water level band of the auto mode feed pump controller
+	boilerFeedPumpOnLevel  = 50 // %
+	boilerFeedPumpOffLevel = 65 // %
+)
+
+type BoilerHandler struct {
+	Lock sync.RWMutex
+
+	coils          [10]bool
+	discreteInputs [10]bool
+
+	burnerPower      float32 // kW
+	capacity         float32 // kg of water when full
+	feedPumpFlow     float32 // kg/s
+	maxSteamFlow     float32 // kg/s at full valve opening and setpoint pressure
+	reliefPressure   float32 // bar
+	highPressureTrip float32 // bar
+	lowWaterTrip     float32 // %
+
+	firingRate       uint16 // %
+	pressureSetpoint uint16 // 0.1 bar
+	steamValve       uint16 // %
+
+	water       float32 // kg
+	temperature float32
+	pressure    float32 // bar, gauge
+	level       float32 // %
+	steamFlow   float32 // kg/s
+	feedFlow    float32 // kg/s
+	reliefFlow  float32 // kg/s
+	heatInput   float32 // kW
+	reliefOpen  bool
+}
+
+func NewBoilerHandler(config config.Boiler) *BoilerHandler {
+	return &BoilerHandler{
+		burnerPower:      config.BurnerPower,
+		capacity:         config.WaterCapacity,
+		feedPumpFlow:     config.FeedPumpFlow,
+		maxSteamFlow:     config.MaxSteamFlow,
+		reliefPressure:   config.ReliefPressure,
+		highPressureTrip: config.HighPressureTrip,
+		lowWaterTrip:     config.LowWaterTrip,
+		pressureSetpoint: uint16(config.PressureSetpoint * 10),
+		water:            config.WaterCapacity * float32(config.InitialWaterLevel) / 100,
+	}
+}
+
+func (h *BoilerHandler) Init() error {
+	// the level is the water over the capacity
+	if h.capacity <= 0 || h.water > h.capacity {
+		return fmt.Errorf("boiler water capacity must be positive, with an initial water level up to 100%%")
+	}
+	if h.burnerPower <= 0 {
+		return fmt.Errorf("boiler burner power must be positive")
+	}
+	// the relief valve would be always open and the trip always active without their pressures
+	if h.reliefPressure <= 0 || h.highPressureTrip <= 0 {
+		return fmt.Errorf("boiler relief pressure and high pressure trip must be positive")
+	}
+	// like the pressure setpoint register, the controller cannot fire above the relief valve
+	if h.pressureSetpoint == 0 || float32(h.pressureSetpoint) > h.reliefPressure*10 {
+		return fmt.Errorf("boiler pressure setpoint must be positive and up to the relief pressure of %v bar", h.reliefPressure)
+	}
+
+	h.temperature = boilerAmbient
+	h.level = h.water / h.capacity * 100
+	h.firingRate = 100
+	h.steamValve = 0
+
+	h.coils[boilerBurnerReg] = false
+	h.coils[boilerFeedPumpReg] = false
+	h.coils[boilerAutoModeReg] = true
+	h.coils[boilerTripResetReg] = false
+
+	return nil
+}
+
+// saturationPressure returns the absolute saturation pressure of water in bar using the Antoine equation
+func saturationPressure(temperature float32) float32 {
+	a, b, c := 8.07131, 1730.63, 233.426
+	if temperature > 100 {
+		a, b, c = 8.14019, 1810.94, 244.485
+	}
+	mmHg := math.Pow(10, a-b/(c+float64(temperature)))
+	return float32(mmHg * 0.00133322)
+}
+
+// latentHeat returns the latent heat of vaporization of water in kJ/kg
+func latentHeat(temperature float32) float32 {
+	return 2501 - 2.361*temperature
+}
+
+// trip latches the given alarm and locks the burner out
+func (h *BoilerHandler) trip(alarm int) {
+	if !h.discreteInputs[alarm] {
+		log.Warnf("Boiler: trip on alarm %v", alarm)
+	}
+	h.discreteInputs[alarm] = true
+	h.discreteInputs[boilerLockoutReg] = true
+	h.coils[boilerBurnerReg] = false
+}
+
+func (h *BoilerHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	// the trip reset coil acts as a push button
+	if h.coils[boilerTripResetReg] {
+		h.coils[boilerTripResetReg] = false
+		h.discreteInputs[boilerHighPressureReg] = false
+		h.discreteInputs[boilerLowWaterReg] = false
+		h.discreteInputs[boilerLockoutReg] = false
+	}
+
+	setpoint := float32(h.pressureSetpoint) / 10
+
+	// in auto mode the feed pump holds the level between its bands
+	// and the firing rate follows the pressure error
+	if h.coils[boilerAutoModeReg] {
+		if h.level < boilerFeedPumpOnLevel {
+			h.coils[boilerFeedPumpReg] = true
+		} else if h.level > boilerFeedPumpOffLevel {
+			h.coils[boilerFeedPumpReg] = false
+		}
+
+		rate := (setpoint - h.pressure) / boilerProportionalBand * 100
+		h.coils[boilerBurnerReg] = rate > 0 && !h.discreteInputs[boilerLockoutReg]
+		h.firingRate = uint16(max(boilerMinFiringRate, min(100, rate)))
+	}
+	log.Debugf("Boiler Burner: %v, Firing Rate: %v, Feed Pump: %v", h.coils[boilerBurnerReg], h.firingRate, h.coils[boilerFeedPumpReg])
+
+	h.heatInput = 0
+	if h.coils[boilerBurnerReg] && !h.discreteInputs[boilerLockoutReg] {
+		h.heatInput = h.burnerPower * float32(max(boilerMinFiringRate, h.firingRate)) / 100
+	}
+
+	h.feedFlow = 0
+	if h.coils[boilerFeedPumpReg] && h.water < h.capacity {
+		h.feedFlow = min(h.feedPumpFlow, h.capacity-h.water)
+	}
+
+	// steam only leaves the vessel once it is pressurized, the flow through
+	// the valves is proportional to the pressure
+	absolute := h.pressure + atmosphericPressure
+	h.steamFlow = 0
+	h.reliefFlow = 0
+	if h.pressure > 0 {
+		h.steamFlow = h.maxSteamFlow * float32(h.steamValve) / 100 * absolute / (setpoint + atmosphericPressure)
+
+		// the relief valve pops open at its set pressure and reseats below its blowdown
+		if h.pressure >= h.reliefPressure {
+			h.reliefOpen = true
+		} else if h.pressure < h.reliefPressure*(1-reliefBlowdown) {
+			h.reliefOpen = false
+		}
+		if h.reliefOpen {
+			capacity := reliefOversize * h.burnerPower / latentHeat(h.temperature)
+			h.reliefFlow = capacity * absolute / (h.reliefPressure + atmosphericPressure)
+		}
+	} else {
+		h.reliefOpen = false
+	}
+	evaporation := min(h.steamFlow+h.reliefFlow, h.water)
+
+	// energy balance over the one second tick
+	heat := h.heatInput*boilerBurnerEfficiency -
+		evaporation*latentHeat(h.temperature) -
+		h.feedFlow*waterSpecificHeat*(h.temperature-boilerFeedwaterTemp) -
+		boilerHeatLoss*h.burnerPower*(h.temperature-boilerAmbient)
+
+	h.water += h.feedFlow - evaporation
+	// keep a minimal thermal mass, a dry boiler heats up very quickly
+	h.temperature += heat / (max(h.water, h.capacity/100) * waterSpecificHeat)
+	h.level = h.water / h.capacity * 100
+	h.pressure = max(0, saturationPressure(h.temperature)-atmosphericPressure)
+	log.Debugf("Boiler Temperature: %v, Pressure: %v, Level: %v", h.temperature, h.pressure, h.level)
+
+	// protections
+	if h.pressure >= h.highPressureTrip {
+		h.trip(boilerHighPressureReg)
+	}
+	if h.level <= h.lowWaterTrip {
+		h.trip(boilerLowWaterReg)
+	}
+
+	h.discreteInputs[boilerFiringReg] = h.heatInput > 0
+	h.discreteInputs[boilerFeedRunningReg] = h.feedFlow > 0
+	h.discreteInputs[boilerReliefOpenReg] = h.reliefOpen
+
+	return nil
+}
+
+func (h *BoilerHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *BoilerHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.discreteInputs) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		res = append(res, h.discreteInputs[int(req.Addr)+i])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *BoilerHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		switch regAddr {
+		case boilerFiringRateReg:
+			if req.IsWrite {
+				if req.Args[i] > 100 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.firingRate = req.Args[i]
+			}
+			res = append(res, h.firingRate)
+
+		case boilerPressureSetpointReg:
+			if req.IsWrite {
+				// the controller cannot be set to fire above the relief valve
+				if float32(req.Args[i]) > h.reliefPressure*10 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.pressureSetpoint = req.Args[i]
+			}
+			res = append(res, h.pressureSetpoint)
+
+		case boilerSteamValveReg:
+			if req.IsWrite {
+				if req.Args[i] > 100 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.steamValve = req.Args[i]
+			}
+			res = append(res, h.steamValve)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *BoilerHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case boilerWaterTempReg:
+			res = append(res, uint16((math.Float32bits(h.temperature)>>16)&0xffff))
+		case boilerWaterTempReg + 1:
+			res = append(res, uint16((math.Float32bits(h.temperature))&0xffff))
+
+		case boilerPressureReg:
+			res = append(res, uint16((math.Float32bits(h.pressure)>>16)&0xffff))
+		case boilerPressureReg + 1:
+			res = append(res, uint16((math.Float32bits(h.pressure))&0xffff))
+
+		case boilerLevelReg:
+			res = append(res, uint16((math.Float32bits(h.level)>>16)&0xffff))
+		case boilerLevelReg + 1:
+			res = append(res, uint16((math.Float32bits(h.level))&0xffff))
+
+		case boilerSteamFlowReg:
+			res = append(res, uint16((math.Float32bits(h.steamFlow)>>16)&0xffff))
+		case boilerSteamFlowReg + 1:
+			res = append(res, uint16((math.Float32bits(h.steamFlow))&0xffff))
+
+		case boilerFeedFlowReg:
+			res = append(res, uint16((math.Float32bits(h.feedFlow)>>16)&0xffff))
+		case boilerFeedFlowReg + 1:
+			res = append(res, uint16((math.Float32bits(h.feedFlow))&0xffff))
+
+		case boilerReliefFlowReg:
+			res = append(res, uint16((math.Float32bits(h.reliefFlow)>>16)&0xffff))
+		case boilerReliefFlowReg + 1:
+			res = append(res, uint16((math.Float32bits(h.reliefFlow))&0xffff))
+
+		case boilerHeatInputReg:
+			res = append(res, uint16((math.Float32bits(h.heatInput)>>16)&0xffff))
+		case boilerHeatInputReg + 1:
+			res = append(res, uint16((math.Float32bits(h.heatInput))&0xffff))
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
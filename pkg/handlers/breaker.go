@@ -0,0 +1,422 @@
+package handler
+
+/*
+* This file contains the handler for the circuit breaker and protection relay
+* simulation. The relay measures the current drawn by the devices connected
+* downstream of the breaker and implements overcurrent protection: ANSI 50
+* (instantaneous) and ANSI 51 (inverse time, IEEE C37.112 curves). A trip
+* opens the breaker and latches until it is reset.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	breakerCloseReg     = 0 // true to close, false to open
+	breakerTripResetReg = 1
+
+	// Discrete Inputs (Read-Only)
+	breakerClosedReg  = 0
+	breakerOpenReg    = 1
+	breakerTrippedReg = 2
+	breakerTrip50Reg  = 3
+	breakerTrip51Reg  = 4
+	breakerPickupReg  = 5
+
+	// Holding Registers (Read/Write)
+	breakerPickupCurrentReg        = 100 // A
+	breakerTimeDialReg             = 101 // hundredths
+	breakerInstantaneousPickupReg  = 102 // A
+	breakerCurveReg                = 103
+	breakerInjectedFaultCurrentReg = 104 // A
+
+	// Input Registers (Read-Only)
+	breakerCurrentReg      = 100
+	breakerPowerReg        = 102
+	breakerTripProgressReg = 104
+	breakerFaultCurrentReg = 106
+	breakerTripCountReg    = 200
+)
+
+// IEEE C37.112 inverse time curves
+const (
+	curveModeratelyInverse = 1
+	curveVeryInverse       = 2
+	curveExtremelyInverse  = 3
+)
+
+// inverseTimeCurve holds the constants of an inverse time curve:
+// trip time = TD * (A / (M^p - 1) + B), reset time = TD * tr / (1 - M^2)
+type inverseTimeCurve struct {
+	a, b, p, tr float64
+}
+
+// tripTime returns the time to trip in s at the given multiple of the pickup current
+func (c inverseTimeCurve) tripTime(timeDial, multiple float64) float64 {
+	return timeDial * (c.a/(math.Pow(multiple, c.p)-1) + c.b)
+}
+
+// resetTime returns the time to reset from a full trip in s at the given multiple of the pickup current
+func (c inverseTimeCurve) resetTime(timeDial, multiple float64) float64 {
+	return timeDial * c.tr / (1 - multiple*multiple)
+}
+
+var inverseTimeCurves = map[uint16]inverseTimeCurve{
+	curveModeratelyInverse: {a: 0.0515, b: 0.114, p: 0.02, tr: 4.85},
+	curveVeryInverse:       {a: 19.61, b: 0.491, p: 2, tr: 21.6},
+	curveExtremelyInverse:  {a: 28.2, b: 0.1217, p: 2, tr: 29.1},
+}
+
+var inverseTimeCurveNames = map[string]uint16{
+	"moderately_inverse": curveModeratelyInverse,
+	"very_inverse":       curveVeryInverse,
+	"extremely_inverse":  curveExtremelyInverse,
+}
+
+type BreakerHandler struct {
+	Lock sync.RWMutex
+
+	coils          [10]bool
+	discreteInputs [10]bool
+
+	nominalVoltage float32 // line to line
+
+	// settings of the configuration, checked in Init
+	timeDialSetting float32
+	curveName       string
+
+	pickupCurrent        uint16 // A
+	timeDial             uint16 // hundredths
+	instantaneousPickup  uint16 // A
+	curve                uint16
+	injectedFaultCurrent uint16 // A
+
+	// power of the downstream devices, updated every tick
+	load float32 // W
+
+	closed       bool
+	current      float32 // A
+	power        float32 // W
+	tripProgress float32 // %, the 51 element trips at 100
+	faultCurrent float32 // A, current measured at the last trip
+	tripCount    uint16
+}
+
+func NewBreakerHandler(config config.Breaker) *BreakerHandler {
+	return &BreakerHandler{
+		nominalVoltage:      config.NominalVoltage,
+		pickupCurrent:       config.PickupCurrent,
+		timeDialSetting:     config.TimeDial,
+		instantaneousPickup: config.InstantaneousPickup,
+		curveName:           config.Curve,
+	}
+}
+
+// SetInput sets the named topology input, the load is the power of the downstream devices in W
+func (h *BreakerHandler) SetInput(port string, value float32) bool {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	switch port {
+	case "load":
+		h.load = value
+		return true
+	}
+	return false
+}
+
+// Power returns the power flowing through the breaker in W
+func (h *BreakerHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return h.power
+}
+
+// Output returns the value of the named topology output: the power in W, or
+// 1 while the breaker is closed and 0 while it is open for the energised output
+func (h *BreakerHandler) Output(port string) (float32, bool) {
+	switch port {
+	case "power":
+		return h.Power(), true
+	case "energised":
+		h.Lock.RLock()
+		defer h.Lock.RUnlock()
+		if h.closed {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (h *BreakerHandler) Init() error {
+	if h.pickupCurrent == 0 {
+		return errors.New("breaker pickup current must be set")
+	}
+	// the current is the power over the line voltage
+	if h.nominalVoltage <= 0 {
+		return errors.New("breaker nominal voltage must be positive")
+	}
+
+	// IEEE time dials range from 0.5 to 15, like the time dial register
+	if h.timeDialSetting == 0 {
+		h.timeDialSetting = 1
+	}
+	if h.timeDialSetting < 0.5 || h.timeDialSetting > 15 {
+		return fmt.Errorf("breaker time dial must be between 0.5 and 15, not %v", h.timeDialSetting)
+	}
+	h.timeDial = uint16(math.Round(float64(h.timeDialSetting) * 100))
+
+	if h.curveName == "" {
+		h.curveName = "very_inverse"
+	}
+	curve, ok := inverseTimeCurveNames[h.curveName]
+	if !ok {
+		return fmt.Errorf("unknown breaker curve: %v", h.curveName)
+	}
+	h.curve = curve
+
+	h.closed = true
+	h.coils[breakerCloseReg] = true
+	h.coils[breakerTripResetReg] = false
+
+	return nil
+}
+
+// trip opens the breaker and latches the trip flag of the given element
+func (h *BreakerHandler) trip(element int) {
+	log.Warnf("Breaker: trip by element %v at %v A", element, h.current)
+	h.closed = false
+	h.coils[breakerCloseReg] = false
+	h.discreteInputs[breakerTrippedReg] = true
+	h.discreteInputs[element] = true
+	h.faultCurrent = h.current
+	h.tripCount++
+	h.tripProgress = 0
+}
+
+func (h *BreakerHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	// the trip reset coil acts as a push button
+	if h.coils[breakerTripResetReg] {
+		h.coils[breakerTripResetReg] = false
+		h.discreteInputs[breakerTrippedReg] = false
+		h.discreteInputs[breakerTrip50Reg] = false
+		h.discreteInputs[breakerTrip51Reg] = false
+	}
+
+	// operate the breaker, it cannot be closed while a trip is latched
+	if h.coils[breakerCloseReg] && !h.closed {
+		if h.discreteInputs[breakerTrippedReg] {
+			log.Warnf("Breaker: close command blocked by a latched trip")
+			h.coils[breakerCloseReg] = false
+		} else {
+			log.Infof("Breaker: closed")
+			h.closed = true
+		}
+	}
+	if !h.coils[breakerCloseReg] && h.closed {
+		log.Infof("Breaker: opened")
+		h.closed = false
+	}
+
+	h.current = 0
+	h.power = 0
+	if h.closed {
+		h.power = h.load
+		h.current = float32(math.Abs(float64(h.load))) / (float32(math.Sqrt(3)) * h.nominalVoltage)
+		h.current += float32(h.injectedFaultCurrent)
+	}
+	log.Debugf("Breaker Closed: %v, Current: %v", h.closed, h.current)
+
+	// 51: the trip progress integrates the inverse time curve above the pickup,
+	// and winds back like an induction disk below it
+	curve := inverseTimeCurves[h.curve]
+	timeDial := float64(h.timeDial) / 100
+	multiple := float64(h.current) / float64(h.pickupCurrent)
+	h.discreteInputs[breakerPickupReg] = h.closed && multiple > 1
+	if h.discreteInputs[breakerPickupReg] {
+		h.tripProgress += float32(100 / curve.tripTime(timeDial, multiple))
+	} else if h.tripProgress > 0 {
+		h.tripProgress = max(0, h.tripProgress-float32(100/curve.resetTime(timeDial, multiple)))
+	}
+	log.Debugf("Breaker Trip Progress: %v", h.tripProgress)
+
+	// 50: instantaneous trip
+	if h.closed && h.instantaneousPickup > 0 && h.current >= float32(h.instantaneousPickup) {
+		h.trip(breakerTrip50Reg)
+	} else if h.closed && h.tripProgress >= 100 {
+		h.trip(breakerTrip51Reg)
+	}
+
+	h.discreteInputs[breakerClosedReg] = h.closed
+	h.discreteInputs[breakerOpenReg] = !h.closed
+
+	return nil
+}
+
+func (h *BreakerHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *BreakerHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.discreteInputs) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		res = append(res, h.discreteInputs[int(req.Addr)+i])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *BreakerHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		switch regAddr {
+		case breakerPickupCurrentReg:
+			if req.IsWrite {
+				if req.Args[i] == 0 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.pickupCurrent = req.Args[i]
+			}
+			res = append(res, h.pickupCurrent)
+
+		case breakerTimeDialReg:
+			if req.IsWrite {
+				// IEEE time dials range from 0.5 to 15
+				if req.Args[i] < 50 || req.Args[i] > 1500 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.timeDial = req.Args[i]
+			}
+			res = append(res, h.timeDial)
+
+		case breakerInstantaneousPickupReg:
+			// 0 disables the instantaneous element
+			if req.IsWrite {
+				h.instantaneousPickup = req.Args[i]
+			}
+			res = append(res, h.instantaneousPickup)
+
+		case breakerCurveReg:
+			if req.IsWrite {
+				if _, ok := inverseTimeCurves[req.Args[i]]; !ok {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.curve = req.Args[i]
+			}
+			res = append(res, h.curve)
+
+		case breakerInjectedFaultCurrentReg:
+			if req.IsWrite {
+				h.injectedFaultCurrent = req.Args[i]
+			}
+			res = append(res, h.injectedFaultCurrent)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *BreakerHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case breakerCurrentReg:
+			res = append(res, uint16((math.Float32bits(h.current)>>16)&0xffff))
+		case breakerCurrentReg + 1:
+			res = append(res, uint16((math.Float32bits(h.current))&0xffff))
+
+		case breakerPowerReg:
+			res = append(res, uint16((math.Float32bits(h.power)>>16)&0xffff))
+		case breakerPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.power))&0xffff))
+
+		case breakerTripProgressReg:
+			res = append(res, uint16((math.Float32bits(h.tripProgress)>>16)&0xffff))
+		case breakerTripProgressReg + 1:
+			res = append(res, uint16((math.Float32bits(h.tripProgress))&0xffff))
+
+		case breakerFaultCurrentReg:
+			res = append(res, uint16((math.Float32bits(h.faultCurrent)>>16)&0xffff))
+		case breakerFaultCurrentReg + 1:
+			res = append(res, uint16((math.Float32bits(h.faultCurrent))&0xffff))
+
+		case breakerTripCountReg:
+			res = append(res, h.tripCount)
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInverseTimeCurveTripTime(t *testing.T) {
+	tests := []struct {
+		curve    uint16
+		timeDial float64
+		multiple float64
+		want     float64
+	}{
+		{curveModeratelyInverse, 1, 2, 3.8032},
+		{curveModeratelyInverse, 1, 10, 1.2068},
+		{curveVeryInverse, 1, 2, 7.0277},
+		{curveVeryInverse, 1, 10, 0.6891},
+		{curveVeryInverse, 0.5, 2, 3.5138},
+		{curveExtremelyInverse, 1, 2, 9.5217},
+		{curveExtremelyInverse, 15, 5, 19.4505},
+	}
+
+	for _, tt := range tests {
+		got := inverseTimeCurves[tt.curve].tripTime(tt.timeDial, tt.multiple)
+		if math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("curve %v trip time at TD %v, M %v = %v, want %v", tt.curve, tt.timeDial, tt.multiple, got, tt.want)
+		}
+	}
+}
+
+func TestInverseTimeCurveResetTime(t *testing.T) {
+	tests := []struct {
+		curve    uint16
+		timeDial float64
+		multiple float64
+		want     float64
+	}{
+		{curveModeratelyInverse, 1, 0.9, 25.5263},
+		{curveVeryInverse, 1, 0, 21.6},
+		{curveVeryInverse, 1, 0.5, 28.8},
+		{curveExtremelyInverse, 2, 0.5, 77.6},
+	}
+
+	for _, tt := range tests {
+		got := inverseTimeCurves[tt.curve].resetTime(tt.timeDial, tt.multiple)
+		if math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("curve %v reset time at TD %v, M %v = %v, want %v", tt.curve, tt.timeDial, tt.multiple, got, tt.want)
+		}
+	}
+}
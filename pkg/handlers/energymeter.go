@@ -0,0 +1,416 @@
+package handler
+
+/*
+* This file contains the handler for the three-phase energy meter simulation.
+* The meter measures a base load plus the aggregate power of the simulated
+* devices listed as its sources. Generating devices (solar, wind turbine,
+* discharging battery) count as negative load and are metered as export.
+ */
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/lopqto/icssimsuite/pkg/sunspec"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Input Registers (Read-Only)
+	meterVoltageL1Reg          = 100
+	meterVoltageL2Reg          = 102
+	meterVoltageL3Reg          = 104
+	meterCurrentL1Reg          = 106
+	meterCurrentL2Reg          = 108
+	meterCurrentL3Reg          = 110
+	meterActivePowerL1Reg      = 112 // W
+	meterActivePowerL2Reg      = 114 // W
+	meterActivePowerL3Reg      = 116 // W
+	meterReactivePowerL1Reg    = 118 // var
+	meterReactivePowerL2Reg    = 120 // var
+	meterReactivePowerL3Reg    = 122 // var
+	meterApparentPowerL1Reg    = 124 // VA
+	meterApparentPowerL2Reg    = 126 // VA
+	meterApparentPowerL3Reg    = 128 // VA
+	meterPowerFactorL1Reg      = 130
+	meterPowerFactorL2Reg      = 132
+	meterPowerFactorL3Reg      = 134
+	meterTotalActivePowerReg   = 136 // W
+	meterTotalReactivePowerReg = 138 // var
+	meterTotalApparentPowerReg = 140 // VA
+	meterTotalPowerFactorReg   = 142
+	meterFrequencyReg          = 144
+	meterImportedEnergyReg     = 146 // kWh
+	meterExportedEnergyReg     = 148 // kWh
+)
+
+type EnergyMeterHandler struct {
+	Lock sync.RWMutex
+
+	nominalVoltage float32 // line to neutral
+	nominalFreq    float32
+	baseLoad       float32 // W
+	powerFactor    float32
+
+	// load of the source devices, updated every tick
+	load float32 // W
+
+	// each phase carries a slightly different share of the load
+	phaseShare [3]float32
+
+	voltage       [3]float32
+	current       [3]float32
+	activePower   [3]float32
+	reactivePower [3]float32
+	apparentPower [3]float32
+	phasePF       [3]float32
+	frequency     float32
+
+	// energy counters are kept in float64 so small increments
+	// are not lost once the totals grow large
+	importedEnergy      float64 // kWh
+	exportedEnergy      float64 // kWh
+	phaseImportedEnergy [3]float64
+	phaseExportedEnergy [3]float64
+
+	sunSpec      bool
+	sunSpecMap   sunspec.Map
+	serialNumber string
+}
+
+func NewEnergyMeterHandler(config config.EnergyMeter) *EnergyMeterHandler {
+	return &EnergyMeterHandler{
+		nominalVoltage: config.NominalVoltage,
+		nominalFreq:    config.Frequency,
+		baseLoad:       config.BaseLoad,
+		powerFactor:    config.PowerFactor,
+		sunSpec:        config.SunSpec,
+		serialNumber:   config.SerialNumber,
+	}
+}
+
+// SetInput sets the named topology input, the load is the aggregate power
+// of the source devices in W, negative when they generate
+func (h *EnergyMeterHandler) SetInput(port string, value float32) bool {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	switch port {
+	case "load":
+		h.load = value
+		return true
+	}
+	return false
+}
+
+func (h *EnergyMeterHandler) Init() error {
+	// the phase currents are derived from the voltage
+	if h.nominalVoltage <= 0 {
+		return fmt.Errorf("energy meter nominal voltage must be positive")
+	}
+	if h.powerFactor <= 0 || h.powerFactor > 1 {
+		h.powerFactor = 1
+	}
+
+	h.phaseShare = [3]float32{0.34, 0.33, 0.33}
+	h.frequency = h.nominalFreq
+	for i := range h.voltage {
+		h.voltage[i] = h.nominalVoltage
+		h.phasePF[i] = h.powerFactor
+	}
+
+	if h.sunSpec {
+		h.updateSunSpec()
+	}
+
+	return nil
+}
+
+func (h *EnergyMeterHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	total := h.baseLoad + h.load
+	log.Debugf("Energy Meter Load: %v", total)
+
+	// the phase shares drift slowly around an even split
+	var shares float32
+	for i := range h.phaseShare {
+		h.phaseShare[i] = max(0.2, h.phaseShare[i]+0.002*(rand.Float32()-0.5))
+		shares += h.phaseShare[i]
+	}
+
+	tanPhi := float32(math.Tan(math.Acos(float64(h.powerFactor))))
+	for i := range h.phaseShare {
+		h.voltage[i] = h.nominalVoltage * (0.99 + 0.02*rand.Float32())
+		h.activePower[i] = total * h.phaseShare[i] / shares
+
+		// the load is inductive, whichever way the active power flows
+		h.reactivePower[i] = float32(math.Abs(float64(h.activePower[i]))) * tanPhi
+		h.apparentPower[i] = float32(math.Hypot(float64(h.activePower[i]), float64(h.reactivePower[i])))
+		h.current[i] = h.apparentPower[i] / h.voltage[i]
+		if h.apparentPower[i] > 0 {
+			h.phasePF[i] = h.activePower[i] / h.apparentPower[i]
+		} else {
+			h.phasePF[i] = 1
+		}
+
+		// energy is integrated over the one second tick
+		energy := float64(h.activePower[i]) / 1000 / 3600
+		if energy > 0 {
+			h.phaseImportedEnergy[i] += energy
+			h.importedEnergy += energy
+		} else {
+			h.phaseExportedEnergy[i] -= energy
+			h.exportedEnergy -= energy
+		}
+	}
+
+	h.frequency = h.nominalFreq + 0.1*(rand.Float32()-0.5)
+	log.Debugf("Energy Meter Import: %v, Export: %v", h.importedEnergy, h.exportedEnergy)
+
+	if h.sunSpec {
+		h.updateSunSpec()
+	}
+
+	return nil
+}
+
+// totals returns the total active, reactive and apparent power and the total power factor
+func (h *EnergyMeterHandler) totals() (p, q, s, pf float32) {
+	for i := range h.activePower {
+		p += h.activePower[i]
+		q += h.reactivePower[i]
+	}
+	s = float32(math.Hypot(float64(p), float64(q)))
+	pf = 1
+	if s > 0 {
+		pf = p / s
+	}
+	return
+}
+
+// updateSunSpec rebuilds the SunSpec map with the common and three phase meter models
+func (h *EnergyMeterHandler) updateSunSpec() {
+	p, q, s, pf := h.totals()
+
+	meter := sunspec.Meter{
+		Phases:         3,
+		Frequency:      float64(h.frequency),
+		Power:          float64(p),
+		ReactivePower:  float64(q),
+		ApparentPower:  float64(s),
+		PowerFactor:    float64(pf) * 100,
+		ImportedEnergy: h.importedEnergy * 1000,
+		ExportedEnergy: h.exportedEnergy * 1000,
+	}
+	for i := 0; i < 3; i++ {
+		meter.Current += float64(h.current[i])
+		meter.Voltage += float64(h.voltage[i]) / 3
+		meter.PhaseCurrent[i] = float64(h.current[i])
+		meter.PhaseVoltage[i] = float64(h.voltage[i])
+		meter.LineVoltage[i] = float64(h.voltage[i]) * math.Sqrt(3)
+		meter.PhasePower[i] = float64(h.activePower[i])
+		meter.PhaseReactivePower[i] = float64(h.reactivePower[i])
+		meter.PhaseApparentPower[i] = float64(h.apparentPower[i])
+		meter.PhasePowerFactor[i] = float64(h.phasePF[i]) * 100
+		meter.PhaseImportedEnergy[i] = h.phaseImportedEnergy[i] * 1000
+		meter.PhaseExportedEnergy[i] = h.phaseExportedEnergy[i] * 1000
+	}
+
+	h.sunSpecMap = sunspec.NewMap(
+		sunspec.CommonModel(sunspec.Common{
+			Manufacturer:  "ICSSimSuite",
+			Model:         "Energy Meter",
+			Version:       "1.0",
+			SerialNumber:  h.serialNumber,
+			DeviceAddress: EnergyMeterUnitId,
+		}),
+		sunspec.MeterModel(meter),
+	)
+}
+
+func (h *EnergyMeterHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	err = modbus.ErrIllegalFunction
+	log.Warn("Illegal function: Coils")
+	return res, err
+}
+
+func (h *EnergyMeterHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	err = modbus.ErrIllegalFunction
+	log.Warn("Illegal function: DiscreteInputs")
+	return res, err
+}
+
+func (h *EnergyMeterHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	// the SunSpec map is the only content of the holding registers, and it is read-only
+	if !h.sunSpec {
+		err = modbus.ErrIllegalFunction
+		log.Warn("Illegal function: HoldingRegisters")
+		return res, err
+	}
+
+	res, ok := h.sunSpecMap.Read(req.Addr, req.Quantity)
+	if !ok || req.IsWrite {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return nil, err
+	}
+
+	log.Tracef("SunSpec Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *EnergyMeterHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	p, q, s, pf := h.totals()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case meterVoltageL1Reg:
+			res = append(res, uint16((math.Float32bits(h.voltage[0])>>16)&0xffff))
+		case meterVoltageL1Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.voltage[0]))&0xffff))
+
+		case meterVoltageL2Reg:
+			res = append(res, uint16((math.Float32bits(h.voltage[1])>>16)&0xffff))
+		case meterVoltageL2Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.voltage[1]))&0xffff))
+
+		case meterVoltageL3Reg:
+			res = append(res, uint16((math.Float32bits(h.voltage[2])>>16)&0xffff))
+		case meterVoltageL3Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.voltage[2]))&0xffff))
+
+		case meterCurrentL1Reg:
+			res = append(res, uint16((math.Float32bits(h.current[0])>>16)&0xffff))
+		case meterCurrentL1Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.current[0]))&0xffff))
+
+		case meterCurrentL2Reg:
+			res = append(res, uint16((math.Float32bits(h.current[1])>>16)&0xffff))
+		case meterCurrentL2Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.current[1]))&0xffff))
+
+		case meterCurrentL3Reg:
+			res = append(res, uint16((math.Float32bits(h.current[2])>>16)&0xffff))
+		case meterCurrentL3Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.current[2]))&0xffff))
+
+		case meterActivePowerL1Reg:
+			res = append(res, uint16((math.Float32bits(h.activePower[0])>>16)&0xffff))
+		case meterActivePowerL1Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.activePower[0]))&0xffff))
+
+		case meterActivePowerL2Reg:
+			res = append(res, uint16((math.Float32bits(h.activePower[1])>>16)&0xffff))
+		case meterActivePowerL2Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.activePower[1]))&0xffff))
+
+		case meterActivePowerL3Reg:
+			res = append(res, uint16((math.Float32bits(h.activePower[2])>>16)&0xffff))
+		case meterActivePowerL3Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.activePower[2]))&0xffff))
+
+		case meterReactivePowerL1Reg:
+			res = append(res, uint16((math.Float32bits(h.reactivePower[0])>>16)&0xffff))
+		case meterReactivePowerL1Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.reactivePower[0]))&0xffff))
+
+		case meterReactivePowerL2Reg:
+			res = append(res, uint16((math.Float32bits(h.reactivePower[1])>>16)&0xffff))
+		case meterReactivePowerL2Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.reactivePower[1]))&0xffff))
+
+		case meterReactivePowerL3Reg:
+			res = append(res, uint16((math.Float32bits(h.reactivePower[2])>>16)&0xffff))
+		case meterReactivePowerL3Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.reactivePower[2]))&0xffff))
+
+		case meterApparentPowerL1Reg:
+			res = append(res, uint16((math.Float32bits(h.apparentPower[0])>>16)&0xffff))
+		case meterApparentPowerL1Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.apparentPower[0]))&0xffff))
+
+		case meterApparentPowerL2Reg:
+			res = append(res, uint16((math.Float32bits(h.apparentPower[1])>>16)&0xffff))
+		case meterApparentPowerL2Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.apparentPower[1]))&0xffff))
+
+		case meterApparentPowerL3Reg:
+			res = append(res, uint16((math.Float32bits(h.apparentPower[2])>>16)&0xffff))
+		case meterApparentPowerL3Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.apparentPower[2]))&0xffff))
+
+		case meterPowerFactorL1Reg:
+			res = append(res, uint16((math.Float32bits(h.phasePF[0])>>16)&0xffff))
+		case meterPowerFactorL1Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.phasePF[0]))&0xffff))
+
+		case meterPowerFactorL2Reg:
+			res = append(res, uint16((math.Float32bits(h.phasePF[1])>>16)&0xffff))
+		case meterPowerFactorL2Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.phasePF[1]))&0xffff))
+
+		case meterPowerFactorL3Reg:
+			res = append(res, uint16((math.Float32bits(h.phasePF[2])>>16)&0xffff))
+		case meterPowerFactorL3Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.phasePF[2]))&0xffff))
+
+		case meterTotalActivePowerReg:
+			res = append(res, uint16((math.Float32bits(p)>>16)&0xffff))
+		case meterTotalActivePowerReg + 1:
+			res = append(res, uint16((math.Float32bits(p))&0xffff))
+
+		case meterTotalReactivePowerReg:
+			res = append(res, uint16((math.Float32bits(q)>>16)&0xffff))
+		case meterTotalReactivePowerReg + 1:
+			res = append(res, uint16((math.Float32bits(q))&0xffff))
+
+		case meterTotalApparentPowerReg:
+			res = append(res, uint16((math.Float32bits(s)>>16)&0xffff))
+		case meterTotalApparentPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(s))&0xffff))
+
+		case meterTotalPowerFactorReg:
+			res = append(res, uint16((math.Float32bits(pf)>>16)&0xffff))
+		case meterTotalPowerFactorReg + 1:
+			res = append(res, uint16((math.Float32bits(pf))&0xffff))
+
+		case meterFrequencyReg:
+			res = append(res, uint16((math.Float32bits(h.frequency)>>16)&0xffff))
+		case meterFrequencyReg + 1:
+			res = append(res, uint16((math.Float32bits(h.frequency))&0xffff))
+
+		case meterImportedEnergyReg:
+			res = append(res, uint16((math.Float32bits(float32(h.importedEnergy))>>16)&0xffff))
+		case meterImportedEnergyReg + 1:
+			res = append(res, uint16((math.Float32bits(float32(h.importedEnergy)))&0xffff))
+
+		case meterExportedEnergyReg:
+			res = append(res, uint16((math.Float32bits(float32(h.exportedEnergy))>>16)&0xffff))
+		case meterExportedEnergyReg + 1:
+			res = append(res, uint16((math.Float32bits(float32(h.exportedEnergy)))&0xffff))
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
@@ -0,0 +1,447 @@
+package handler
+
+/*
+* This file contains the handler for the diesel generator set simulation.
+* The genset goes through a start sequence (crank, warm-up, running,
+* cooldown, stopped) either on the remote start command or, in auto mode,
+* when the mains fail. Protective shutdowns latch until the alarms are reset.
+ */
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	gensetRemoteStartReg  = 0
+	gensetAutoModeReg     = 1
+	gensetMainsHealthyReg = 2 // simulated utility supply, clear it to simulate an outage
+	gensetAlarmResetReg   = 3
+
+	// Discrete Inputs (Read-Only)
+	gensetRunningReg         = 0
+	gensetOverspeedReg       = 1
+	gensetLowOilPressureReg  = 2
+	gensetHighCoolantTempReg = 3
+	gensetLowFuelReg         = 4
+	gensetFailToStartReg     = 5
+	gensetShutdownReg        = 6
+
+	// Holding Registers (Read/Write)
+	gensetLoadDemandReg    = 100 // kW
+	gensetSpeedSetpointReg = 101 // RPM
+
+	// Input Registers (Read-Only)
+	gensetRPMReg          = 100
+	gensetVoltageReg      = 102
+	gensetFrequencyReg    = 104
+	gensetCoolantTempReg  = 106
+	gensetOilPressureReg  = 108
+	gensetFuelLevelReg    = 110
+	gensetLoadReg         = 112
+	gensetRunningHoursReg = 114
+	gensetStateReg        = 200
+)
+
+// Genset states
+const (
+	gensetStateStopped  = 0
+	gensetStateCranking = 1
+	gensetStateWarmup   = 2
+	gensetStateRunning  = 3
+	gensetStateCooldown = 4
+	gensetStateFault    = 5
+)
+
+const (
+	crankingRPM = 200
+	// speed droop of the governor at rated load
+	governorDroop = 0.03
+	// speed deviation caused by a load step of the rated power
+	loadStepSpeedDeviation = 0.1
+	overspeedTrip          = 1.15 // of the rated RPM
+	// oil pressure at rated RPM
+	ratedOilPressure = 4.5 // bar
+	lowOilPressure   = 1.5 // bar
+	// oil pressure is not checked while the engine comes up to speed
+	oilPressureGracePeriod = 10 // seconds
+	highCoolantTemperature = 105
+	lowFuelLevel           = 10 // %
+	gensetAmbient          = 25
+)
+
+type GensetHandler struct {
+	Lock sync.RWMutex
+
+	coils          [10]bool
+	discreteInputs [10]bool
+
+	ratedPower      float32 // kW
+	ratedRPM        float32
+	ratedVoltage    float32
+	ratedFrequency  float32
+	crankTime       uint16  // seconds
+	warmupTime      uint16  // seconds
+	cooldownTime    uint16  // seconds
+	fuelCapacity    float32 // L
+	fuelConsumption float32 // L/h at rated power
+
+	loadDemand    uint16 // kW
+	speedSetpoint uint16 // RPM
+
+	state        uint16
+	stateTimer   uint16
+	rpm          float32
+	voltage      float32
+	frequency    float32
+	coolantTemp  float32
+	oilPressure  float32
+	fuel         float32 // L
+	load         float32 // kW
+	runningHours float64 // kept in float64 so the one second increments are not lost
+}
+
+func NewGensetHandler(config config.Genset) *GensetHandler {
+	return &GensetHandler{
+		ratedPower:      config.RatedPower,
+		ratedRPM:        config.RatedRPM,
+		ratedVoltage:    config.RatedVoltage,
+		ratedFrequency:  config.RatedFrequency,
+		crankTime:       config.CrankTime,
+		warmupTime:      config.WarmupTime,
+		cooldownTime:    config.CooldownTime,
+		fuelCapacity:    config.FuelCapacity,
+		fuelConsumption: config.FuelConsumption,
+		fuel:            config.FuelCapacity * float32(config.InitialFuelLevel) / 100,
+	}
+}
+
+// Power returns the power drawn by the genset in W, negative when it supplies a load
+func (h *GensetHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return -h.load * 1000
+}
+
+// Output returns the value of the named topology output
+func (h *GensetHandler) Output(port string) (float32, bool) {
+	switch port {
+	case "power":
+		return h.Power(), true
+	}
+	return 0, false
+}
+
+func (h *GensetHandler) Init() error {
+	// the load, the governor and the fuel level are relative to the ratings
+	if h.ratedPower <= 0 || h.ratedRPM <= 0 || h.ratedRPM > math.MaxUint16 {
+		return fmt.Errorf("genset rated power and rated RPM must be positive, the RPM up to %v", math.MaxUint16)
+	}
+	if h.fuelCapacity <= 0 || h.fuel > h.fuelCapacity {
+		return fmt.Errorf("genset fuel capacity must be positive, with an initial fuel level up to 100%%")
+	}
+
+	h.state = gensetStateStopped
+	h.speedSetpoint = uint16(h.ratedRPM)
+	h.loadDemand = uint16(h.ratedPower / 2)
+	h.coolantTemp = gensetAmbient
+
+	h.coils[gensetRemoteStartReg] = false
+	h.coils[gensetAutoModeReg] = true
+	h.coils[gensetMainsHealthyReg] = true
+	h.coils[gensetAlarmResetReg] = false
+
+	return nil
+}
+
+// setState moves to the given state and restarts the state timer
+func (h *GensetHandler) setState(state uint16) {
+	log.Infof("Genset: state %v -> %v", h.state, state)
+	h.state = state
+	h.stateTimer = 0
+}
+
+// shutdown stops the engine and latches the given alarm
+func (h *GensetHandler) shutdown(alarm int) {
+	log.Warnf("Genset: shutdown on alarm %v", alarm)
+	h.discreteInputs[alarm] = true
+	h.discreteInputs[gensetShutdownReg] = true
+	h.setState(gensetStateFault)
+}
+
+func (h *GensetHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	h.stateTimer++
+
+	// the alarm reset coil acts as a push button
+	if h.coils[gensetAlarmResetReg] {
+		h.coils[gensetAlarmResetReg] = false
+		for i := range h.discreteInputs {
+			h.discreteInputs[i] = false
+		}
+		if h.state == gensetStateFault {
+			h.setState(gensetStateStopped)
+		}
+	}
+
+	// in auto mode the genset backs up the mains, otherwise it follows the remote start command
+	runRequest := h.coils[gensetRemoteStartReg]
+	if h.coils[gensetAutoModeReg] {
+		runRequest = !h.coils[gensetMainsHealthyReg]
+	}
+	log.Debugf("Genset Run Request: %v, State: %v", runRequest, h.state)
+
+	switch h.state {
+	case gensetStateStopped:
+		if runRequest {
+			h.setState(gensetStateCranking)
+		}
+	case gensetStateCranking:
+		if h.fuel <= 0 {
+			h.shutdown(gensetFailToStartReg)
+		} else if h.stateTimer >= h.crankTime {
+			h.setState(gensetStateWarmup)
+		}
+	case gensetStateWarmup:
+		if !runRequest {
+			h.setState(gensetStateStopped)
+		} else if h.stateTimer >= h.warmupTime {
+			h.setState(gensetStateRunning)
+		}
+	case gensetStateRunning:
+		if !runRequest {
+			h.setState(gensetStateCooldown)
+		}
+	case gensetStateCooldown:
+		if runRequest {
+			h.setState(gensetStateRunning)
+		} else if h.stateTimer >= h.cooldownTime {
+			h.setState(gensetStateStopped)
+		}
+	}
+
+	engineRunning := h.state == gensetStateWarmup || h.state == gensetStateRunning || h.state == gensetStateCooldown
+
+	// the load is only connected while running
+	previousLoad := h.load
+	h.load = 0
+	if h.state == gensetStateRunning {
+		h.load = min(float32(h.loadDemand), h.ratedPower*1.1)
+	}
+
+	// the governor holds the speed setpoint with some droop, load steps
+	// make the speed dip or overshoot before it settles again
+	switch {
+	case engineRunning:
+		target := float32(h.speedSetpoint) * (1 - governorDroop*h.load/h.ratedPower)
+		h.rpm += (target - h.rpm) * 0.3
+		h.rpm -= (h.load - previousLoad) / h.ratedPower * loadStepSpeedDeviation * h.ratedRPM
+	case h.state == gensetStateCranking:
+		h.rpm = crankingRPM
+	default:
+		h.rpm += (0 - h.rpm) * 0.3
+	}
+	h.rpm = max(0, h.rpm)
+
+	h.frequency = h.ratedFrequency * h.rpm / h.ratedRPM
+	h.voltage = 0
+	if engineRunning {
+		// the AVR holds the voltage as long as the engine is near its rated speed
+		h.voltage = h.ratedVoltage * min(1, h.rpm/(0.9*h.ratedRPM))
+	}
+
+	// oil pressure follows the engine speed
+	h.oilPressure = ratedOilPressure * h.rpm / h.ratedRPM
+
+	// the coolant warms up with the load and cools down to the ambient temperature when stopped
+	coolantTarget := float32(gensetAmbient)
+	if engineRunning {
+		coolantTarget = 80 + 20*(h.load/h.ratedPower)*(h.load/h.ratedPower)
+	}
+	h.coolantTemp += (coolantTarget - h.coolantTemp) / 120
+
+	// fuel is burnt proportionally to the load, idling takes a quarter of the full load consumption
+	if engineRunning || h.state == gensetStateCranking {
+		h.fuel -= h.fuelConsumption * (0.25 + 0.75*h.load/h.ratedPower) / 3600
+		h.fuel = max(0, h.fuel)
+	}
+	// the running hours only count the running state
+	if h.state == gensetStateRunning {
+		h.runningHours += 1.0 / 3600
+	}
+	log.Debugf("Genset RPM: %v, Load: %v, Fuel: %v", h.rpm, h.load, h.fuel)
+
+	// protections
+	h.discreteInputs[gensetRunningReg] = h.state == gensetStateRunning
+	h.discreteInputs[gensetLowFuelReg] = h.fuel/h.fuelCapacity*100 < lowFuelLevel
+	if engineRunning {
+		switch {
+		case h.rpm > overspeedTrip*h.ratedRPM:
+			h.shutdown(gensetOverspeedReg)
+		case h.oilPressure < lowOilPressure && (h.state != gensetStateWarmup || h.stateTimer > oilPressureGracePeriod):
+			h.shutdown(gensetLowOilPressureReg)
+		case h.coolantTemp > highCoolantTemperature:
+			h.shutdown(gensetHighCoolantTempReg)
+		case h.fuel <= 0:
+			h.shutdown(gensetLowFuelReg)
+		}
+	}
+
+	return nil
+}
+
+func (h *GensetHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *GensetHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.discreteInputs) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		res = append(res, h.discreteInputs[int(req.Addr)+i])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *GensetHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		switch regAddr {
+		case gensetLoadDemandReg:
+			if req.IsWrite {
+				h.loadDemand = req.Args[i]
+			}
+			res = append(res, h.loadDemand)
+
+		case gensetSpeedSetpointReg:
+			if req.IsWrite {
+				// the governor accepts up to 130% of the rated speed
+				if float32(req.Args[i]) > 1.3*h.ratedRPM {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.speedSetpoint = req.Args[i]
+			}
+			res = append(res, h.speedSetpoint)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *GensetHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	fuelLevel := h.fuel / h.fuelCapacity * 100
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case gensetRPMReg:
+			res = append(res, uint16((math.Float32bits(h.rpm)>>16)&0xffff))
+		case gensetRPMReg + 1:
+			res = append(res, uint16((math.Float32bits(h.rpm))&0xffff))
+
+		case gensetVoltageReg:
+			res = append(res, uint16((math.Float32bits(h.voltage)>>16)&0xffff))
+		case gensetVoltageReg + 1:
+			res = append(res, uint16((math.Float32bits(h.voltage))&0xffff))
+
+		case gensetFrequencyReg:
+			res = append(res, uint16((math.Float32bits(h.frequency)>>16)&0xffff))
+		case gensetFrequencyReg + 1:
+			res = append(res, uint16((math.Float32bits(h.frequency))&0xffff))
+
+		case gensetCoolantTempReg:
+			res = append(res, uint16((math.Float32bits(h.coolantTemp)>>16)&0xffff))
+		case gensetCoolantTempReg + 1:
+			res = append(res, uint16((math.Float32bits(h.coolantTemp))&0xffff))
+
+		case gensetOilPressureReg:
+			res = append(res, uint16((math.Float32bits(h.oilPressure)>>16)&0xffff))
+		case gensetOilPressureReg + 1:
+			res = append(res, uint16((math.Float32bits(h.oilPressure))&0xffff))
+
+		case gensetFuelLevelReg:
+			res = append(res, uint16((math.Float32bits(fuelLevel)>>16)&0xffff))
+		case gensetFuelLevelReg + 1:
+			res = append(res, uint16((math.Float32bits(fuelLevel))&0xffff))
+
+		case gensetLoadReg:
+			res = append(res, uint16((math.Float32bits(h.load)>>16)&0xffff))
+		case gensetLoadReg + 1:
+			res = append(res, uint16((math.Float32bits(h.load))&0xffff))
+
+		case gensetRunningHoursReg:
+			res = append(res, uint16((math.Float32bits(float32(h.runningHours))>>16)&0xffff))
+		case gensetRunningHoursReg + 1:
+			res = append(res, uint16((math.Float32bits(float32(h.runningHours)))&0xffff))
+
+		case gensetStateReg:
+			res = append(res, h.state)
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
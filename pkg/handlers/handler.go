@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"fmt"
 	"time"
 
 	config "github.com/lopqto/icssimsuite/pkg/config"
@@ -10,52 +11,213 @@ import (
 )
 
 const (
-	HVACUnitId         = 1
-	PulseCounterUnitId = 2
-	WaterTankUnitId    = 3
+	HVACUnitId           = 1
+	PulseCounterUnitId   = 2
+	WaterTankUnitId      = 3
+	ModbusClientUnitId   = 4
+	BatteryUnitId        = 5
+	SolarUnitId          = 6
+	WindTurbineUnitId    = 7
+	EnergyMeterUnitId    = 8
+	GensetUnitId         = 9
+	BreakerUnitId        = 10
+	BoilerUnitId         = 11
+	VFDUnitId            = 12
+	WaterTreatmentUnitId = 13
+	TrafficSignalUnitId  = 14
+	HydraulicsUnitId     = 15
+	ValveUnitId          = 16
+	PIDUnitId            = 17
 )
 
 type Handler struct {
 	config  *config.Config
 	weather *weather.Weather
 
-	hvacHandler         *HVACHandler
-	pulseCounterHandler *PulseCounterHandler
-	waterTankHandler    *WaterTankHandler
+	// enabled devices in registration order, looked up by unit ID and by name
+	devices []*device
+	units   map[uint8]*device
+	names   map[string]*device
+
+	// enabled devices in update order, set by Init
+	order []*device
+
+	// devices depending on the weather, nil when disabled
+	hvacHandler        *HVACHandler
+	batteryHandler     *BatteryHandler
+	solarHandler       *SolarHandler
+	windTurbineHandler *WindTurbineHandler
+}
+
+func NewHandler(config *config.Config) (*Handler, error) {
+	h := &Handler{
+		config:  config,
+		weather: weather.NewWeather(config.OpenWeatherMap),
+		units:   make(map[uint8]*device),
+		names:   make(map[string]*device),
+	}
+
+	if config.HVAC.Enabled {
+		h.hvacHandler = NewHVACHandler(config.HVAC)
+		h.register("hvac", HVACUnitId, h.hvacHandler)
+	}
+
+	if config.PulseCounter.Enabled {
+		h.register("pulsecounter", PulseCounterUnitId, NewPulseCounterHandler(config.PulseCounter))
+	}
+
+	if config.WaterTank.Enabled {
+		h.register("watertank", WaterTankUnitId, NewWaterTankHandler(config.WaterTank))
+	}
+
+	if config.ModbusClient.Enabled {
+		h.register("modbusclient", ModbusClientUnitId, NewModbusClientHandler(config.ModbusClient))
+	}
+
+	if config.Battery.Enabled {
+		h.batteryHandler = NewBatteryHandler(config.Battery)
+		h.register("battery", BatteryUnitId, h.batteryHandler)
+	}
+
+	if config.Solar.Enabled {
+		h.solarHandler = NewSolarHandler(config.Solar)
+		h.register("solar", SolarUnitId, h.solarHandler)
+	}
+
+	if config.WindTurbine.Enabled {
+		h.windTurbineHandler = NewWindTurbineHandler(config.WindTurbine)
+		h.register("windturbine", WindTurbineUnitId, h.windTurbineHandler)
+	}
+
+	if config.EnergyMeter.Enabled {
+		h.register("energymeter", EnergyMeterUnitId, NewEnergyMeterHandler(config.EnergyMeter))
+	}
+
+	if config.Genset.Enabled {
+		h.register("genset", GensetUnitId, NewGensetHandler(config.Genset))
+	}
+
+	if config.Breaker.Enabled {
+		h.register("breaker", BreakerUnitId, NewBreakerHandler(config.Breaker))
+	}
+
+	if config.Boiler.Enabled {
+		h.register("boiler", BoilerUnitId, NewBoilerHandler(config.Boiler))
+	}
+
+	if config.VFD.Enabled {
+		h.register("vfd", VFDUnitId, NewVFDHandler(config.VFD))
+	}
+
+	if config.WaterTreatment.Enabled {
+		h.register("watertreatment", WaterTreatmentUnitId, NewWaterTreatmentHandler(config.WaterTreatment))
+	}
+
+	if config.TrafficSignal.Enabled {
+		h.register("trafficsignal", TrafficSignalUnitId, NewTrafficSignalHandler(config.TrafficSignal))
+	}
+
+	if config.Hydraulics.Enabled {
+		h.register("hydraulics", HydraulicsUnitId, NewHydraulicsHandler(config.Hydraulics))
+	}
+
+	if config.Valve.Enabled {
+		h.register("valve", ValveUnitId, NewValveHandler(config.Valve))
+	}
+
+	if config.PID.Enabled {
+		h.register("pid", PIDUnitId, NewPIDHandler(config.PID))
+	}
+
+	// the additional water tanks have their own name and unit ID
+	for _, tank := range config.WaterTanks {
+		if tank.Enabled {
+			h.register(tank.Name, tank.UnitId, NewWaterTankHandler(tank))
+		}
+	}
+
+	// the same name or unit ID can only be used once
+	if len(h.units) != len(h.devices) || len(h.names) != len(h.devices) {
+		return nil, h.duplicateError()
+	}
+
+	return h, nil
 }
 
-func NewHandler(config *config.Config) *Handler {
-	weather := weather.NewWeather(config.OpenWeatherMap)
+// register adds an enabled device to the handler
+func (h *Handler) register(name string, unitId uint8, handler Device) {
+	d := &device{name: name, unitId: unitId, handler: handler}
+	h.devices = append(h.devices, d)
+	if _, ok := h.units[unitId]; !ok {
+		h.units[unitId] = d
+	}
+	if _, ok := h.names[name]; !ok {
+		h.names[name] = d
+	}
+}
 
-	hvacHandler := NewHVACHandler(config.HVAC)
-	pulseCounterHandler := NewPulseCounterHandler(config.PulseCounter)
-	waterTankHandler := NewWaterTankHandler(config.WaterTank)
+// duplicateError describes the first device reusing a name or a unit ID
+func (h *Handler) duplicateError() error {
+	for _, d := range h.devices {
+		if h.units[d.unitId] != d {
+			return fmt.Errorf("unit ID %v is used by both %v and %v", d.unitId, h.units[d.unitId].name, d.name)
+		}
+		if h.names[d.name] != d {
+			return fmt.Errorf("device name %q is used more than once", d.name)
+		}
+	}
+	return nil
+}
 
-	return &Handler{
-		config:              config,
-		weather:             weather,
-		hvacHandler:         hvacHandler,
-		pulseCounterHandler: pulseCounterHandler,
-		waterTankHandler:    waterTankHandler,
+// links returns the topology links, including the ones implied by the device settings
+func (h *Handler) links() []config.Link {
+	var links []config.Link
+
+	for _, name := range h.config.EnergyMeter.Sources {
+		links = append(links, config.Link{From: name + ".power", To: "energymeter.load"})
+	}
+	for _, name := range h.config.Breaker.Sources {
+		links = append(links, config.Link{From: name + ".power", To: "breaker.load"})
+		// the supplied sources are de-energised while the breaker is open
+		if d, ok := h.names[name]; ok {
+			if _, ok := d.handler.(suppliedDevice); ok {
+				links = append(links, config.Link{From: "breaker.energised", To: name + ".supply"})
+			}
+		}
+	}
+	if h.config.WaterTreatment.WaterTankOutflow {
+		links = append(links, config.Link{From: "watertank.outflow", To: "watertreatment.inflow"})
 	}
+
+	return append(links, h.config.Topology.Links...)
 }
 
 func (h *Handler) Init() error {
-	if h.config.HVAC.Enabled {
-		log.Infof("Booting HVAC")
-		h.hvacHandler.Init()
+	for _, d := range h.devices {
+		if d.unitId == 0 {
+			return fmt.Errorf("%v has no unit ID", d.name)
+		}
 	}
 
-	if h.config.PulseCounter.Enabled {
-		log.Infof("Booting Pulse Counter")
-		h.pulseCounterHandler.Init()
+	links := h.links()
+	if len(links) > 0 {
+		log.Infof("Connecting Topology")
+	}
+	for _, l := range links {
+		if err := h.connect(l.From, l.To); err != nil {
+			return err
+		}
 	}
 
-	if h.config.WaterTank.Enabled {
-		log.Infof("Booting Water Tank")
-		h.waterTankHandler.Init()
+	for _, d := range h.devices {
+		log.Infof("Booting %v (Unit ID: %v)", d.name, d.unitId)
+		if err := d.handler.Init(); err != nil {
+			return fmt.Errorf("%v: %w", d.name, err)
+		}
 	}
 
+	h.order = h.updateOrder()
+
 	return nil
 }
 
@@ -65,44 +227,53 @@ func (h *Handler) Ticker() {
 	for {
 		select {
 		case t := <-ticker.C:
-			// hvacHandler is only updated if the HVAC is enabled
-			if h.config.HVAC.Enabled {
-				h.hvacHandler.Update()
-
-				if t.Second()%120 == 0 {
-					w, err := h.weather.GetCurrentWeather()
-					if err != nil {
-						log.Errorf("Error: %v", err)
-					} else {
+			// the weather is only fetched if a device depends on it
+			if t.Second()%120 == 0 && h.weatherRequired() {
+				w, err := h.weather.GetCurrentWeather()
+				if err != nil {
+					log.Errorf("Error: %v", err)
+				} else {
+					if h.hvacHandler != nil {
 						h.hvacHandler.SetTemperature(w.Temperature)
 						h.hvacHandler.SetHumidity(w.Humidity)
 					}
+					if h.batteryHandler != nil {
+						h.batteryHandler.SetTemperature(w.Temperature)
+					}
+					if h.solarHandler != nil {
+						h.solarHandler.SetTemperature(w.Temperature)
+						h.solarHandler.SetCloudCover(w.CloudCover)
+					}
+					if h.windTurbineHandler != nil {
+						h.windTurbineHandler.SetWindSpeed(w.WindSpeed)
+						h.windTurbineHandler.SetWindDirection(w.WindDirection)
+					}
 				}
 			}
 
-			if h.config.PulseCounter.Enabled {
-				h.pulseCounterHandler.Update()
-			}
-
-			if h.config.WaterTank.Enabled {
-				h.waterTankHandler.Update()
+			// each device reads the current outputs of the devices linked to its inputs
+			for _, d := range h.order {
+				d.resolveInputs()
+				if err := d.handler.Update(); err != nil {
+					log.Errorf("Error: %v: %v", d.name, err)
+				}
 			}
 		}
 	}
 }
 
+// weatherRequired reports whether any enabled device depends on the weather
+func (h *Handler) weatherRequired() bool {
+	return h.hvacHandler != nil ||
+		h.batteryHandler != nil ||
+		h.solarHandler != nil ||
+		h.windTurbineHandler != nil
+}
+
 // Coil handler method.
 func (h *Handler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
-	if req.UnitId == HVACUnitId && h.config.HVAC.Enabled {
-		return h.hvacHandler.HandleCoils(req)
-	}
-
-	if req.UnitId == PulseCounterUnitId && h.config.PulseCounter.Enabled {
-		return h.pulseCounterHandler.HandleCoils(req)
-	}
-
-	if req.UnitId == WaterTankUnitId && h.config.WaterTank.Enabled {
-		return h.waterTankHandler.HandleCoils(req)
+	if d, ok := h.units[req.UnitId]; ok {
+		return d.handler.HandleCoils(req)
 	}
 
 	err = modbus.ErrIllegalFunction
@@ -113,16 +284,8 @@ func (h *Handler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error)
 
 // Discrete input handler method.
 func (h *Handler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
-	if req.UnitId == HVACUnitId && h.config.HVAC.Enabled {
-		return h.hvacHandler.HandleDiscreteInputs(req)
-	}
-
-	if req.UnitId == PulseCounterUnitId && h.config.PulseCounter.Enabled {
-		return h.pulseCounterHandler.HandleDiscreteInputs(req)
-	}
-
-	if req.UnitId == WaterTankUnitId && h.config.WaterTank.Enabled {
-		return h.waterTankHandler.HandleDiscreteInputs(req)
+	if d, ok := h.units[req.UnitId]; ok {
+		return d.handler.HandleDiscreteInputs(req)
 	}
 
 	err = modbus.ErrIllegalFunction
@@ -133,16 +296,8 @@ func (h *Handler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res [
 // Holding register handler method.
 // operation (either read or write) received by the server.
 func (h *Handler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
-	if req.UnitId == HVACUnitId && h.config.HVAC.Enabled {
-		return h.hvacHandler.HandleHoldingRegisters(req)
-	}
-
-	if req.UnitId == PulseCounterUnitId && h.config.PulseCounter.Enabled {
-		return h.pulseCounterHandler.HandleHoldingRegisters(req)
-	}
-
-	if req.UnitId == WaterTankUnitId && h.config.WaterTank.Enabled {
-		return h.waterTankHandler.HandleHoldingRegisters(req)
+	if d, ok := h.units[req.UnitId]; ok {
+		return d.handler.HandleHoldingRegisters(req)
 	}
 
 	err = modbus.ErrIllegalFunction
@@ -155,16 +310,8 @@ func (h *Handler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (r
 // operation is received by the server.
 // Note that input registers are always read-only as per the modbus spec.
 func (h *Handler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
-	if req.UnitId == HVACUnitId && h.config.HVAC.Enabled {
-		return h.hvacHandler.HandleInputRegisters(req)
-	}
-
-	if req.UnitId == PulseCounterUnitId && h.config.PulseCounter.Enabled {
-		return h.pulseCounterHandler.HandleInputRegisters(req)
-	}
-
-	if req.UnitId == WaterTankUnitId && h.config.WaterTank.Enabled {
-		return h.waterTankHandler.HandleInputRegisters(req)
+	if d, ok := h.units[req.UnitId]; ok {
+		return d.handler.HandleInputRegisters(req)
 	}
 
 	err = modbus.ErrIllegalFunction
@@ -0,0 +1,96 @@
+package handler
+
+/*
+* This file contains the indoor air model of the HVAC. The moisture and the
+* CO2 of the room are mixed with the outside air by the infiltration and by
+* the outdoor air drawn by the supply fan. The occupants, following an hourly
+* schedule, add moisture and CO2, and the cooling coil condenses moisture
+* while the room air is above the coil dew point.
+ */
+
+import (
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	barometricPressure = 101325 // Pa
+	airDensity         = 1.2    // kg/m3
+	condensationHeat   = 2.45e6 // J/kg, condensation of water
+
+	// per occupant at office activity
+	occupantMoisture = 0.07 / 3600 // kg/s
+	occupantCO2      = 0.0052e-3   // m3/s
+
+	// the cooling coil runs at this temperature, the room air condenses
+	// on the coil when its dew point is above
+	coilTemperature = 10 // C
+	// share of the cooling output spent on condensation
+	latentRatio = 0.2
+)
+
+// vapourSaturationPressure returns the water vapour saturation pressure in Pa at
+// the given temperature in C, from the Magnus formula
+func vapourSaturationPressure(temperature float32) float64 {
+	t := float64(temperature)
+	return 610.94 * math.Exp(17.625*t/(t+243.04))
+}
+
+// humidityRatio returns the kg of water per kg of dry air at the given
+// temperature in C and relative humidity in %
+func humidityRatio(temperature float32, humidity float32) float64 {
+	pv := float64(humidity) / 100 * vapourSaturationPressure(temperature)
+	return 0.622 * pv / (barometricPressure - pv)
+}
+
+// vapourPressure returns the water vapour pressure in Pa of the given humidity ratio
+func vapourPressure(ratio float64) float64 {
+	return barometricPressure * ratio / (0.622 + ratio)
+}
+
+// dewPoint returns the temperature in C at which the given humidity ratio saturates
+func dewPoint(ratio float64) float32 {
+	x := math.Log(max(vapourPressure(ratio), 1) / 610.94)
+	return float32(243.04 * x / (17.625 - x))
+}
+
+// updateAir runs the indoor air model over the one second tick with the
+// supply airflow as a fraction of the max airflow
+func (h *HVACHandler) updateAir(airflow float32) {
+	// the occupants follow the schedule, a written value holds until the next hour
+	if len(h.occupancy) > 0 {
+		if hour := time.Now().Hour(); hour != h.occupancyHour {
+			h.occupancyHour = hour
+			h.occupants = h.occupancy[hour]
+		}
+	}
+
+	// air changes per hour, from the infiltration and the outdoor air of the fan
+	h.airChanges = h.infiltration + h.outdoorAirflow*airflow/h.roomVolume
+	exchange := float64(h.airChanges) / 3600
+	occupants := float64(h.occupants)
+	mass := airDensity * float64(h.roomVolume)
+
+	// the moisture of the room mixes with the outside air, the occupants add
+	// moisture and the cooling coil condenses it below its dew point
+	outside := humidityRatio(h.temperature, h.humidity)
+	moisture := occupants * occupantMoisture
+	if h.compressorRunning && dewPoint(h.moisture) > coilTemperature {
+		moisture -= float64(h.coolingOutput) * latentRatio / condensationHeat
+	}
+	h.moisture += exchange*(outside-h.moisture) + moisture/mass
+	// the room air never holds more than its saturation
+	saturated := humidityRatio(h.roomTemperature, 100)
+	h.moisture = max(0, min(saturated, h.moisture))
+
+	h.indoorHumidity = float32(100 * vapourPressure(h.moisture) / vapourSaturationPressure(h.roomTemperature))
+	h.dewPoint = dewPoint(h.moisture)
+
+	// the CO2 of the room mixes with the outside air, the occupants exhale CO2
+	h.co2 += float32(exchange)*(h.outdoorCO2-h.co2) + float32(occupants*occupantCO2/float64(h.roomVolume)*1e6)
+
+	log.Debugf("Indoor Humidity: %v, Dew Point: %v, CO2: %v, Occupants: %v, Air Changes: %v",
+		h.indoorHumidity, h.dewPoint, h.co2, h.occupants, h.airChanges)
+}
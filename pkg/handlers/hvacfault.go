@@ -0,0 +1,86 @@
+package handler
+
+/*
+* This file contains the equipment faults of the HVAC. The filter clogs and
+* the fan bearing wears while the fan runs, and the compressor can fail at a
+* scheduled uptime. The faults can also be set through their registers, so a
+* test can script when and how badly the equipment fails.
+ */
+
+import (
+	"math/rand"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fault code bits
+const (
+	hvacFaultFilter     = 1 << 0
+	hvacFaultCompressor = 1 << 1
+	hvacFaultFanBearing = 1 << 2
+)
+
+const (
+	// a fully clogged filter chokes this share of the airflow
+	hvacClogAirflowLoss = 0.6
+	// a fully clogged filter or worn bearing raises the fan draw this much
+	hvacClogFanLoad    = 0.4
+	hvacBearingFanLoad = 0.3
+
+	// the filter alarm is raised above this clog
+	hvacFilterAlarm = 50 // %
+	// the fan vibration of a healthy and a fully worn bearing at max fan speed
+	hvacBaseVibration = 1  // mm/s
+	hvacWornVibration = 20 // mm/s
+	// the bearing alarm is raised above this vibration
+	hvacVibrationAlarm = 4.5 // mm/s
+)
+
+// updateFaults progresses the faults over the one second tick
+func (h *HVACHandler) updateFaults() {
+	if h.fanState {
+		h.filterClog = min(100, h.filterClog+h.filterClogRate/3600)
+		h.bearingWear = min(100, h.bearingWear+h.bearingWearRate/3600)
+	}
+	if h.compressorFailureTime > 0 && h.uptime == h.compressorFailureTime {
+		h.compressorFailed = true
+	}
+	log.Debugf("Filter Clog: %v, Bearing Wear: %v, Compressor Failed: %v", h.filterClog, h.bearingWear, h.compressorFailed)
+}
+
+// filterAirflow returns the share of the airflow passing the filter
+func (h *HVACHandler) filterAirflow() float32 {
+	return 1 - hvacClogAirflowLoss*h.filterClog/100
+}
+
+// fanLoad returns the factor of the fan draw from the clogged filter and the worn bearing
+func (h *HVACHandler) fanLoad() float32 {
+	return 1 + hvacClogFanLoad*h.filterClog/100 + hvacBearingFanLoad*h.bearingWear/100
+}
+
+// fanVibration returns the vibration of the fan in mm/s at the given speed,
+// as a fraction of the max speed, rising with the square of the bearing wear
+func fanVibration(speed float32, wear float32) float32 {
+	if speed == 0 {
+		return 0
+	}
+	wear /= 100
+	vibration := (hvacBaseVibration + (hvacWornVibration-hvacBaseVibration)*wear*wear) * speed
+	// the measurement is noisy by up to 5%
+	return vibration * (1 + (rand.Float32()-0.5)/10)
+}
+
+// faultCode returns the bits of the faults raising their alarms
+func (h *HVACHandler) faultCode() uint16 {
+	code := uint16(0)
+	if h.filterClog >= hvacFilterAlarm {
+		code |= hvacFaultFilter
+	}
+	if h.compressorFailed {
+		code |= hvacFaultCompressor
+	}
+	if h.vibration >= hvacVibrationAlarm {
+		code |= hvacFaultFanBearing
+	}
+	return code
+}
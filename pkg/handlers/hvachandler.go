@@ -1,8 +1,10 @@
 package handler
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
+	"strings"
 	"sync"
 
 	"github.com/lopqto/icssimsuite/pkg/config"
@@ -12,19 +14,88 @@ import (
 
 const (
 	// Holding Registers (Read/Write)
-	fanSpeedReg = 100
+	fanSpeedReg         = 100
+	setpointReg         = 101 // 0.1 C
+	deadbandReg         = 102 // 0.1 C
+	hvacModeReg         = 103
+	occupantsReg        = 104
+	filterClogReg       = 105 // %
+	bearingWearReg      = 106 // %
+	compressorFailedReg = 107
 
 	// Coils
-	fanStateReg = 1
+	fanStateReg         = 1
+	compressorReg       = 2
+	heaterReg           = 3
+	hvacCounterResetReg = 4 // resets the energy, run hours and start counters
+
+	// Discrete Inputs (Read-Only)
+	coolingCallReg       = 0
+	heatingCallReg       = 1
+	fanRunningReg        = 2
+	compressorRunningReg = 3
+	heaterRunningReg     = 4
+	filterAlarmReg       = 5
+	compressorFaultReg   = 6
+	bearingAlarmReg      = 7
 
 	// Input Registers (Read-Only)
-	temperatureReg = 100
-	humidityReg    = 102
-	roomTempReg    = 104
-	voltageReg     = 106
-	currentReg     = 108
-	powerReg       = 110
-	uptimeReg      = 200
+	temperatureReg      = 100
+	humidityReg         = 102
+	roomTempReg         = 104
+	voltageReg          = 106
+	currentReg          = 108
+	powerReg            = 110
+	fanPowerReg         = 112 // W
+	compressorPowerReg  = 114 // W
+	heaterPowerReg      = 116 // W
+	coolingOutputReg    = 118 // W, heat removed from the room
+	indoorHumidityReg   = 120 // %
+	dewPointReg         = 122 // C
+	co2Reg              = 124 // ppm
+	airChangesReg       = 126 // per hour
+	vibrationReg        = 128 // mm/s
+	faultCodeReg        = 130 // uint16
+	energyReg           = 132 // kWh, float64
+	fanHoursReg         = 136 // h
+	compressorHoursReg  = 138 // h
+	fanStartsReg        = 140 // uint32
+	compressorStartsReg = 142 // uint32
+	uptimeReg           = 200
+)
+
+// HVAC modes
+const (
+	hvacModeManual  = 0 // the fan follows the fan state coil and the fan speed register
+	hvacModeOff     = 1
+	hvacModeAuto    = 2 // the thermostat cools or heats to hold the setpoint
+	hvacModeCool    = 3
+	hvacModeHeat    = 4
+	hvacModeFanOnly = 5 // the fan runs at the fan speed register, without cooling or heating
+)
+
+// hvacModes maps the modes of the configuration to their values
+var hvacModes = map[string]uint16{
+	"":         hvacModeManual,
+	"manual":   hvacModeManual,
+	"off":      hvacModeOff,
+	"auto":     hvacModeAuto,
+	"cool":     hvacModeCool,
+	"heat":     hvacModeHeat,
+	"fan_only": hvacModeFanOnly,
+}
+
+const (
+	hvacDefaultVoltage = 220 // V
+	// the voltage fluctuates by up to this much around the nominal voltage
+	hvacVoltageFluctuation = 5 // V
+	// the equipment of a small split unit when it is not configured, the fan
+	// draws 0.5 A at max speed
+	hvacDefaultFanPower        = 110  // W
+	hvacDefaultCoolingCapacity = 3500 // W
+	hvacDefaultHeaterPower     = 3000 // W
+	// the compressor waits this long after stopping before it restarts
+	compressorMinOffTime = 180 // seconds
 )
 
 type HVACHandler struct {
@@ -43,7 +114,7 @@ type HVACHandler struct {
 
 	temperature     float32
 	humidity        float32
-	roomTemperature float32
+	roomTemperature float32 // average of the zones
 	voltage         float32
 	current         float32
 	power           float32
@@ -51,14 +122,126 @@ type HVACHandler struct {
 	idleCurrent    float32
 	maxFanSpeed    uint16
 	roomTempOffset float32
+	nominalVoltage float32
+
+	// thermal model
+	fanPower        float32 // W at max fan speed
+	coolingCapacity float32 // W
+	cop             float32
+	heaterPower     float32 // W
+
+	// the equipment only runs while the supply is energised, e.g. through a breaker
+	energised bool
+
+	compressorRunning bool
+	compressorOffTime uint32 // seconds since the compressor stopped
+	heaterRunning     bool
+	fanDraw           float32 // W
+	compressorDraw    float32 // W
+	heaterDraw        float32 // W
+	coolingOutput     float32 // W
+
+	// thermostat
+	setpoint    uint16 // 0.1 C
+	deadband    uint16 // 0.1 C
+	mode        uint16
+	modeName    string
+	coolingCall bool
+	heatingCall bool
+
+	// indoor air
+	roomVolume     float32 // m3
+	infiltration   float32 // air changes per hour
+	outdoorAirflow float32 // m3/h at max fan speed
+	outdoorCO2     float32 // ppm
+	occupancy      []uint16
+	occupancyHour  int
+	occupants      uint16
+	airChanges     float32 // per hour
+	moisture       float64 // kg of water per kg of dry air
+	indoorHumidity float32 // %
+	dewPoint       float32 // C
+	co2            float32 // ppm
+
+	// counters, the energy and the run hours are kept in float64 so small increments are not lost
+	energy           float64 // kWh
+	fanHours         float64
+	compressorHours  float64
+	fanStarts        uint32
+	compressorStarts uint32
+
+	// faults
+	filterClog            float32 // %
+	filterClogRate        float32 // % per hour of fan running
+	bearingWear           float32 // %
+	bearingWearRate       float32 // % per hour of fan running
+	compressorFailed      bool
+	compressorFailureTime uint32  // uptime at which the compressor fails
+	vibration             float32 // mm/s
+
+	// zones served by the HVAC, a single zone unless the zones are configured
+	zones      []*hvacZone
+	names      map[string]*hvacZone
+	zoned      bool
+	zoneBase   uint16
+	zoneStride uint16
 }
 
 func NewHVACHandler(config config.HVAC) *HVACHandler {
-	return &HVACHandler{
+	h := &HVACHandler{
 		idleCurrent:    config.IdleCurrent,
 		maxFanSpeed:    config.MaxFanSpeed,
 		roomTempOffset: config.RoomTempOffset,
+		nominalVoltage: config.NominalVoltage,
+		setpoint:       uint16(config.Setpoint * 10),
+		deadband:       uint16(config.Deadband * 10),
+		mode:           hvacModes[config.Mode],
+		modeName:       config.Mode,
+
+		fanPower:        config.FanPower,
+		coolingCapacity: config.CoolingCapacity,
+		cop:             config.COP,
+		heaterPower:     config.HeaterPower,
+
+		roomVolume:     config.RoomVolume,
+		infiltration:   config.Infiltration,
+		outdoorAirflow: config.OutdoorAirflow,
+		outdoorCO2:     config.OutdoorCO2,
+		occupancy:      config.Occupancy,
+
+		filterClog:            config.FilterClog,
+		filterClogRate:        config.FilterClogRate,
+		bearingWear:           config.BearingWear,
+		bearingWearRate:       config.BearingWearRate,
+		compressorFailed:      config.CompressorFailed,
+		compressorFailureTime: config.CompressorFailureTime,
+
+		names:      make(map[string]*hvacZone),
+		zoned:      len(config.Zones) > 0,
+		zoneBase:   config.ZoneBase,
+		zoneStride: config.ZoneStride,
+	}
+
+	for _, c := range config.Zones {
+		h.zones = append(h.zones, newHVACZone(c))
 	}
+	if !h.zoned {
+		// without zones the HVAC serves a single room
+		h.zones = append(h.zones, &hvacZone{
+			name:          "room",
+			thermalMass:   config.ThermalMass,
+			envelopeUA:    config.EnvelopeUA,
+			internalGains: config.InternalGains,
+			damper:        100,
+		})
+	}
+	for _, z := range h.zones {
+		if _, ok := h.names[z.name]; !ok {
+			h.names[z.name] = z
+		}
+	}
+
+	return h
 }
 
 func (h *HVACHandler) SetTemperature(temperature float32) {
@@ -73,6 +256,58 @@ func (h *HVACHandler) SetHumidity(humidity float32) {
 	h.Lock.Unlock()
 }
 
+// Power returns the electrical power drawn by the HVAC in W
+func (h *HVACHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return h.power
+}
+
+// Energised reports whether the supply of the HVAC is energised
+func (h *HVACHandler) Energised() bool {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return h.energised
+}
+
+// SetInput sets the named topology input, the fan speed is in RPM and the
+// supply is energised above 0.5
+func (h *HVACHandler) SetInput(port string, value float32) bool {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	switch port {
+	case "fan_speed":
+		h.fanSpeed = uint16(max(0, min(float32(h.maxFanSpeed), value)))
+		return true
+	case "supply":
+		h.energised = value >= 0.5
+		return true
+	}
+	return false
+}
+
+// Output returns the value of the named topology output: the power in W, the
+// average room temperature or the temperature of a zone ("zone.temperature")
+func (h *HVACHandler) Output(port string) (float32, bool) {
+	switch port {
+	case "power":
+		return h.Power(), true
+	case "room_temperature":
+		h.Lock.RLock()
+		defer h.Lock.RUnlock()
+		return h.roomTemperature, true
+	}
+
+	name, output, _ := strings.Cut(port, ".")
+	if z, ok := h.names[name]; ok && output == "temperature" {
+		h.Lock.RLock()
+		defer h.Lock.RUnlock()
+		return z.temperature, true
+	}
+	return 0, false
+}
+
 func (h *HVACHandler) Init() error {
 	// There is no need to lock because we
 	// are running this function once before the server starts
@@ -81,10 +316,95 @@ func (h *HVACHandler) Init() error {
 	h.humidity = 50
 	h.roomTemperature = h.temperature + h.roomTempOffset
 	h.fanSpeed = 400
-	h.voltage = 220
+	if h.nominalVoltage == 0 {
+		h.nominalVoltage = hvacDefaultVoltage
+	}
+	// the current is the power over the voltage, which must stay positive
+	if h.nominalVoltage <= hvacVoltageFluctuation {
+		return fmt.Errorf("HVAC nominal voltage must be above %v V", hvacVoltageFluctuation)
+	}
+	h.voltage = h.nominalVoltage
+	h.energised = true
 	h.current = h.idleCurrent
 	h.power = h.voltage * h.current
 	h.coils[fanStateReg] = false
+	h.coils[compressorReg] = false
+	h.coils[heaterReg] = false
+	h.coils[hvacCounterResetReg] = false
+	h.compressorOffTime = compressorMinOffTime
+
+	// without its power the equipment would draw nothing, leaving only the idle current
+	if h.fanPower < 0 || h.coolingCapacity < 0 || h.heaterPower < 0 {
+		return fmt.Errorf("HVAC fan power, cooling capacity and heater power must not be negative")
+	}
+	if h.fanPower == 0 {
+		h.fanPower = hvacDefaultFanPower
+	}
+	if h.coolingCapacity == 0 {
+		h.coolingCapacity = hvacDefaultCoolingCapacity
+	}
+	if h.heaterPower == 0 {
+		h.heaterPower = hvacDefaultHeaterPower
+	}
+	if h.cop <= 0 {
+		h.cop = 3
+	}
+
+	if _, ok := hvacModes[h.modeName]; !ok {
+		return fmt.Errorf("unknown HVAC mode: %v", h.modeName)
+	}
+	if h.setpoint == 0 {
+		h.setpoint = 220
+	}
+	if h.deadband == 0 {
+		h.deadband = 10
+	}
+
+	if h.roomVolume <= 0 {
+		h.roomVolume = 250
+	}
+	if h.infiltration <= 0 {
+		h.infiltration = 0.3
+	}
+	if h.outdoorAirflow <= 0 {
+		h.outdoorAirflow = 2 * h.roomVolume
+	}
+	if h.outdoorCO2 <= 0 {
+		h.outdoorCO2 = 420
+	}
+	if len(h.occupancy) != 0 && len(h.occupancy) != 24 {
+		return fmt.Errorf("HVAC occupancy schedule must have 24 hourly values")
+	}
+	// the room air starts as the outside air
+	h.occupancyHour = -1
+	h.moisture = humidityRatio(h.temperature, h.humidity)
+	h.co2 = h.outdoorCO2
+
+	if h.filterClog < 0 || h.filterClog > 100 || h.bearingWear < 0 || h.bearingWear > 100 {
+		return fmt.Errorf("HVAC filter clog and bearing wear must be between 0 and 100")
+	}
+
+	if len(h.names) != len(h.zones) {
+		return fmt.Errorf("HVAC zone names must be unique")
+	}
+	for _, z := range h.zones {
+		if err := z.init(h.temperature, h.roomTempOffset, h.setpoint); err != nil {
+			return err
+		}
+	}
+
+	if h.zoneBase == 0 {
+		h.zoneBase = hvacDefaultZoneBase
+	}
+	if h.zoneStride == 0 {
+		h.zoneStride = hvacDefaultZoneStride
+	}
+	// the zone registers come after the HVAC registers and fit in the address space
+	if h.zoneStride < zoneRegisters || h.zoneBase <= uptimeReg+1 ||
+		int(h.zoneBase)+len(h.zones)*int(h.zoneStride) > math.MaxUint16+1 {
+		return fmt.Errorf("HVAC zone registers must start after address %v with a stride of at least %v", uptimeReg+1, zoneRegisters)
+	}
+
 	return nil
 
 }
@@ -97,13 +417,25 @@ func (h *HVACHandler) Update() error {
 	// increment the uptime counter
 	h.uptime++
 
-	// check fan fanState
-	if h.coils[fanStateReg] {
-		h.fanState = true
-	} else {
-		h.fanState = false
+	h.thermostat()
+
+	// the counter reset coil acts as a push button
+	if h.coils[hvacCounterResetReg] {
+		h.coils[hvacCounterResetReg] = false
+		h.energy = 0
+		h.fanHours = 0
+		h.compressorHours = 0
+		h.fanStarts = 0
+		h.compressorStarts = 0
+	}
+
+	// check fan fanState, the fan stops while the supply is de-energised
+	fanState := h.coils[fanStateReg] && h.energised
+	if fanState && !h.fanState {
+		h.fanStarts++
 	}
-	log.Debugf("Fan State: %v", h.fanState)
+	h.fanState = fanState
+	log.Debugf("Fan State: %v, Energised: %v", h.fanState, h.energised)
 
 	// turn off the fan if the fanState is false
 	if !h.fanState {
@@ -111,32 +443,159 @@ func (h *HVACHandler) Update() error {
 	}
 	log.Debugf("Fan Speed: %v", h.fanSpeed)
 
-	// update the room temperature based on the fan speed and the outside temperature
-	targetTemp := h.temperature - (float32(h.fanSpeed) * 0.02) + h.roomTempOffset
-	log.Debugf("Outside Temp: %v", h.temperature)
-	log.Debugf("Target Temp: %v", targetTemp)
-	// Room tempretature will slowly adjust to the target temperature based on a logaritmic function
-	//h.roomTemperature = h.roomTemperature + (targetTemp - h.roomTemperature) * 0.1
-	if h.roomTemperature < targetTemp {
-		h.roomTemperature += 0.1
-	} else if h.roomTemperature > targetTemp {
-		h.roomTemperature -= 0.1
+	h.updateFaults()
+
+	// the fan power follows the cube of the fan speed, the clogged filter and
+	// the worn bearing load the fan, and the clogged filter chokes the airflow
+	speed := float32(0)
+	if h.fanState && h.maxFanSpeed > 0 {
+		speed = min(1, float32(h.fanSpeed)/float32(h.maxFanSpeed))
+	}
+	h.fanDraw = h.fanPower * speed * speed * speed * h.fanLoad()
+	h.vibration = fanVibration(speed, h.bearingWear)
+	airflow := speed * h.filterAirflow()
+
+	// the supply airflow is split between the zones in proportion to their
+	// dampers, no air flows when all the dampers are closed
+	dampers := float32(0)
+	for _, z := range h.zones {
+		dampers += float32(z.damper)
+	}
+	if dampers == 0 {
+		airflow = 0
+	}
+
+	// the compressor and the heater need the fan to blow over their coils,
+	// the compressor is also held off for its minimum off time
+	h.compressorOffTime++
+	compressor := h.coils[compressorReg] && airflow > 0 && !h.compressorFailed
+	if compressor && !h.compressorRunning && h.compressorOffTime < compressorMinOffTime {
+		compressor = false
+	}
+	if !compressor && h.compressorRunning {
+		h.compressorOffTime = 0
+	}
+	if compressor && !h.compressorRunning {
+		h.compressorStarts++
+	}
+	h.compressorRunning = compressor
+	h.heaterRunning = h.coils[heaterReg] && airflow > 0
+	log.Debugf("Compressor: %v, Heater: %v", h.compressorRunning, h.heaterRunning)
+
+	// the capacity delivered to the room drops with the airflow
+	h.coolingOutput = 0
+	h.compressorDraw = 0
+	if h.compressorRunning {
+		h.coolingOutput = h.coolingCapacity * float32(math.Sqrt(float64(airflow)))
+		h.compressorDraw = h.coolingCapacity / h.cop
+	}
+	heating := float32(0)
+	h.heaterDraw = 0
+	if h.heaterRunning {
+		h.heaterDraw = h.heaterPower
+		heating = h.heaterPower
 	}
+
+	// each zone receives its share of the supply air, the fan heat ends up in the zones
+	h.roomTemperature = 0
+	for _, z := range h.zones {
+		share := float32(0)
+		if dampers > 0 {
+			share = float32(z.damper) / dampers
+		}
+		z.airflow = airflow * share * 100
+		z.heat = (h.fanDraw + heating - h.coolingOutput) * share
+		z.update(h.temperature)
+		h.roomTemperature += z.temperature / float32(len(h.zones))
+	}
+	log.Debugf("Outside Temp: %v", h.temperature)
 	log.Debugf("Room Temp: %v", h.roomTemperature)
 
-	// update the power consumption based on the fan fanSpeed
-	// voltage sometimes fluctuates, so we'll add a random value between -5 and 5
-	h.voltage = 220 + float32((rand.Intn(10) - 5))
+	h.updateAir(airflow)
 
-	h.current = (float32(h.fanSpeed) / 1000) + h.idleCurrent
-	log.Debugf("Current: %v", h.current)
+	// voltage sometimes fluctuates, so we'll add a random value between -5 and 5,
+	// a de-energised HVAC has no voltage and draws nothing
+	h.voltage = 0
+	h.power = 0
+	h.current = 0
+	if h.energised {
+		h.voltage = h.nominalVoltage + float32((rand.Intn(2*hvacVoltageFluctuation) - hvacVoltageFluctuation))
 
-	h.power = h.voltage * h.current
+		// the current follows the equipment running
+		h.power = h.voltage*h.idleCurrent + h.fanDraw + h.compressorDraw + h.heaterDraw
+		h.current = h.power / h.voltage
+	}
 	log.Debugf("Power: %v", h.power)
+	log.Debugf("Current: %v", h.current)
+
+	// the energy and the run hours are integrated over the one second tick
+	h.energy += float64(h.power) / 1000 / 3600
+	if h.fanState {
+		h.fanHours += 1.0 / 3600
+	}
+	if h.compressorRunning {
+		h.compressorHours += 1.0 / 3600
+	}
+	log.Debugf("Energy: %v, Fan Starts: %v, Compressor Starts: %v", h.energy, h.fanStarts, h.compressorStarts)
 
 	return nil
 }
 
+// thermostat calls for cooling or heating to hold the room temperature at the
+// setpoint, and runs the fan while it calls. The cooling starts above the
+// setpoint plus the deadband and the heating below the setpoint minus the
+// deadband, both stop once the room temperature is back at the setpoint.
+func (h *HVACHandler) thermostat() {
+	if h.mode == hvacModeManual {
+		h.coolingCall = false
+		h.heatingCall = false
+		return
+	}
+
+	// the HVAC cools when a zone calls for cooling and heats when a zone
+	// calls for heating and none for cooling
+	deadband := float32(h.deadband) / 10
+	h.coolingCall = false
+	h.heatingCall = false
+	for _, z := range h.zones {
+		z.thermostat(h.mode, deadband)
+		h.coolingCall = h.coolingCall || z.coolingCall
+		h.heatingCall = h.heatingCall || z.heatingCall
+	}
+	h.heatingCall = h.heatingCall && !h.coolingCall
+
+	// the dampers open for the zones served and close to their minimum for the others
+	if h.mode != hvacModeOff {
+		for _, z := range h.zones {
+			served := (h.coolingCall && z.coolingCall) || (h.heatingCall && z.heatingCall) ||
+				(!h.coolingCall && !h.heatingCall && h.mode == hvacModeFanOnly)
+			if served {
+				z.damper = 100
+			} else {
+				z.damper = hvacMinDamper
+			}
+		}
+	}
+	log.Debugf("Thermostat Mode: %v, Cooling Call: %v, Heating Call: %v", h.mode, h.coolingCall, h.heatingCall)
+
+	// the thermostat drives the compressor, the heater and the fan,
+	// the fan only mode runs the fan at the fan speed register
+	h.coils[compressorReg] = h.coolingCall
+	h.coils[heaterReg] = h.heatingCall
+	switch {
+	case h.coolingCall || h.heatingCall:
+		h.coils[fanStateReg] = true
+		h.fanSpeed = h.maxFanSpeed
+	case h.mode == hvacModeFanOnly:
+		h.coils[fanStateReg] = true
+		if h.fanSpeed == 0 {
+			h.fanSpeed = h.maxFanSpeed
+		}
+	default:
+		h.coils[fanStateReg] = false
+	}
+}
+
 func (h *HVACHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
 	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
 		err = modbus.ErrIllegalDataAddress
@@ -161,9 +620,46 @@ func (h *HVACHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err err
 }
 
 func (h *HVACHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
-	err = modbus.ErrIllegalFunction
-	log.Warn("Illegal function: DiscreteInputs")
-	return res, err
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+		case coolingCallReg:
+			res = append(res, h.coolingCall)
+		case heatingCallReg:
+			res = append(res, h.heatingCall)
+		case fanRunningReg:
+			res = append(res, h.fanState)
+		case compressorRunningReg:
+			res = append(res, h.compressorRunning)
+		case heaterRunningReg:
+			res = append(res, h.heaterRunning)
+		case filterAlarmReg:
+			res = append(res, h.faultCode()&hvacFaultFilter != 0)
+		case compressorFaultReg:
+			res = append(res, h.faultCode()&hvacFaultCompressor != 0)
+		case bearingAlarmReg:
+			res = append(res, h.faultCode()&hvacFaultFanBearing != 0)
+
+		default:
+			var value bool
+			z, offset, ok := h.zone(regAddr)
+			if ok {
+				value, ok = z.discreteInput(offset)
+			}
+			if !ok {
+				err = modbus.ErrIllegalDataAddress
+				log.Warnf("Illegal data address: %v", regAddr)
+				return
+			}
+			res = append(res, value)
+		}
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
 }
 
 func (h *HVACHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
@@ -185,7 +681,7 @@ func (h *HVACHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest
 		case fanSpeedReg:
 			if req.IsWrite {
 				// check if the value is within the allowed range
-				if req.Args[i] > h.maxFanSpeed && req.Args[i] < 0 {
+				if req.Args[i] > h.maxFanSpeed {
 					err = modbus.ErrIllegalDataValue
 					log.Warnf("Illegal data value: %v", req.Args[i])
 					return
@@ -194,11 +690,102 @@ func (h *HVACHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest
 			}
 			res = append(res, h.fanSpeed)
 
-		// any other address is unknown
+		case setpointReg:
+			if req.IsWrite {
+				// the thermostat accepts setpoints between 5 and 35 C
+				if req.Args[i] < 50 || req.Args[i] > 350 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				// the unit setpoint applies to all the zones
+				h.setpoint = req.Args[i]
+				for _, z := range h.zones {
+					z.setpoint = req.Args[i]
+				}
+			}
+			res = append(res, h.setpoint)
+
+		case deadbandReg:
+			if req.IsWrite {
+				if req.Args[i] == 0 || req.Args[i] > 100 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.deadband = req.Args[i]
+			}
+			res = append(res, h.deadband)
+
+		case hvacModeReg:
+			if req.IsWrite {
+				if req.Args[i] > hvacModeFanOnly {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.mode = req.Args[i]
+			}
+			res = append(res, h.mode)
+
+		case occupantsReg:
+			// a written value holds until the next hour of the occupancy schedule
+			if req.IsWrite {
+				h.occupants = req.Args[i]
+			}
+			res = append(res, h.occupants)
+
+		case filterClogReg, bearingWearReg:
+			value := &h.filterClog
+			if regAddr == bearingWearReg {
+				value = &h.bearingWear
+			}
+			if req.IsWrite {
+				if req.Args[i] > 100 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				*value = float32(req.Args[i])
+			}
+			res = append(res, uint16(*value))
+
+		case compressorFailedReg:
+			if req.IsWrite {
+				if req.Args[i] > 1 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.compressorFailed = req.Args[i] == 1
+			}
+			if h.compressorFailed {
+				res = append(res, 1)
+			} else {
+				res = append(res, 0)
+			}
+
+		// any other address is a zone register or unknown
 		default:
-			err = modbus.ErrIllegalDataAddress
-			log.Warnf("Illegal data address: %v", regAddr)
-			return
+			var value *uint16
+			var minValue, maxValue uint16
+			if z, offset, ok := h.zone(regAddr); ok {
+				value, minValue, maxValue = z.holdingRegister(offset)
+			}
+			if value == nil {
+				err = modbus.ErrIllegalDataAddress
+				log.Warnf("Illegal data address: %v", regAddr)
+				return
+			}
+			if req.IsWrite {
+				if req.Args[i] < minValue || req.Args[i] > maxValue {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				*value = req.Args[i]
+			}
+			res = append(res, *value)
 		}
 	}
 
@@ -208,6 +795,8 @@ func (h *HVACHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest
 }
 
 func (h *HVACHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
 
 	// loop through all register addresses from req.addr to req.addr + req.Quantity - 1
 	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
@@ -243,6 +832,79 @@ func (h *HVACHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (r
 		case powerReg + 1:
 			res = append(res, uint16((math.Float32bits(h.power))&0xffff))
 
+		case fanPowerReg:
+			res = append(res, uint16((math.Float32bits(h.fanDraw)>>16)&0xffff))
+		case fanPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.fanDraw))&0xffff))
+
+		case compressorPowerReg:
+			res = append(res, uint16((math.Float32bits(h.compressorDraw)>>16)&0xffff))
+		case compressorPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.compressorDraw))&0xffff))
+
+		case heaterPowerReg:
+			res = append(res, uint16((math.Float32bits(h.heaterDraw)>>16)&0xffff))
+		case heaterPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.heaterDraw))&0xffff))
+
+		case coolingOutputReg:
+			res = append(res, uint16((math.Float32bits(h.coolingOutput)>>16)&0xffff))
+		case coolingOutputReg + 1:
+			res = append(res, uint16((math.Float32bits(h.coolingOutput))&0xffff))
+
+		case indoorHumidityReg:
+			res = append(res, uint16((math.Float32bits(h.indoorHumidity)>>16)&0xffff))
+		case indoorHumidityReg + 1:
+			res = append(res, uint16((math.Float32bits(h.indoorHumidity))&0xffff))
+
+		case dewPointReg:
+			res = append(res, uint16((math.Float32bits(h.dewPoint)>>16)&0xffff))
+		case dewPointReg + 1:
+			res = append(res, uint16((math.Float32bits(h.dewPoint))&0xffff))
+
+		case co2Reg:
+			res = append(res, uint16((math.Float32bits(h.co2)>>16)&0xffff))
+		case co2Reg + 1:
+			res = append(res, uint16((math.Float32bits(h.co2))&0xffff))
+
+		case airChangesReg:
+			res = append(res, uint16((math.Float32bits(h.airChanges)>>16)&0xffff))
+		case airChangesReg + 1:
+			res = append(res, uint16((math.Float32bits(h.airChanges))&0xffff))
+
+		case vibrationReg:
+			res = append(res, uint16((math.Float32bits(h.vibration)>>16)&0xffff))
+		case vibrationReg + 1:
+			res = append(res, uint16((math.Float32bits(h.vibration))&0xffff))
+
+		case faultCodeReg:
+			res = append(res, h.faultCode())
+
+		// the energy is a float64, highest word first
+		case energyReg, energyReg + 1, energyReg + 2, energyReg + 3:
+			shift := 16 * (3 - (regAddr - energyReg))
+			res = append(res, uint16((math.Float64bits(h.energy)>>shift)&0xffff))
+
+		case fanHoursReg:
+			res = append(res, uint16((math.Float32bits(float32(h.fanHours))>>16)&0xffff))
+		case fanHoursReg + 1:
+			res = append(res, uint16((math.Float32bits(float32(h.fanHours)))&0xffff))
+
+		case compressorHoursReg:
+			res = append(res, uint16((math.Float32bits(float32(h.compressorHours))>>16)&0xffff))
+		case compressorHoursReg + 1:
+			res = append(res, uint16((math.Float32bits(float32(h.compressorHours)))&0xffff))
+
+		case fanStartsReg:
+			res = append(res, uint16((h.fanStarts>>16)&0xffff))
+		case fanStartsReg + 1:
+			res = append(res, uint16(h.fanStarts&0xffff))
+
+		case compressorStartsReg:
+			res = append(res, uint16((h.compressorStarts>>16)&0xffff))
+		case compressorStartsReg + 1:
+			res = append(res, uint16(h.compressorStarts&0xffff))
+
 		case uptimeReg:
 			res = append(res, uint16((h.uptime>>16)&0xffff))
 		case uptimeReg + 1:
@@ -250,9 +912,21 @@ func (h *HVACHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (r
 
 		// exception client-side.
 		default:
-			log.Warnf("Illegal data address: %v", regAddr)
-			err = modbus.ErrIllegalDataAddress
-			return
+			var value float32
+			z, offset, ok := h.zone(regAddr)
+			if ok {
+				value, ok = z.inputRegister(offset &^ 1)
+			}
+			if !ok {
+				log.Warnf("Illegal data address: %v", regAddr)
+				err = modbus.ErrIllegalDataAddress
+				return
+			}
+			if offset%2 == 0 {
+				res = append(res, uint16((math.Float32bits(value)>>16)&0xffff))
+			} else {
+				res = append(res, uint16((math.Float32bits(value))&0xffff))
+			}
 		}
 	}
 
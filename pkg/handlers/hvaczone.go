@@ -0,0 +1,173 @@
+package handler
+
+/*
+* This file contains the zones served by the HVAC. Each zone is a room with
+* its own thermal model, setpoint and supply air damper. The supply fan
+* airflow, and the cooling or heating it carries, is split between the zones
+* in proportion to their damper openings.
+ */
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Offsets within a zone block, the blocks start at the zone base and are one zone stride apart
+const (
+	// Discrete Inputs (Read-Only)
+	zoneCoolingCallReg = 0
+	zoneHeatingCallReg = 1
+
+	// Holding Registers (Read/Write)
+	zoneSetpointReg = 0 // 0.1 C
+	zoneDamperReg   = 1 // %
+
+	// Input Registers (Read-Only)
+	zoneTemperatureReg = 0
+	zoneAirflowReg     = 2 // % of the maximum supply airflow
+	zoneHeatReg        = 4 // W delivered by the HVAC, negative when cooling
+
+	// the number of registers of a zone block, the stride must fit them
+	zoneRegisters = 6
+)
+
+const (
+	// the dampers of the zones not served stay open this much for ventilation
+	hvacMinDamper = 20 // %
+	// the zone registers start after the HVAC registers
+	hvacDefaultZoneBase   = 1000
+	hvacDefaultZoneStride = 10
+)
+
+type hvacZone struct {
+	name          string
+	thermalMass   float32 // kJ/K
+	envelopeUA    float32 // W/K
+	internalGains float32 // W
+
+	setpoint uint16 // 0.1 C
+	damper   uint16 // %
+
+	temperature float32
+	airflow     float32 // % of the maximum supply airflow
+	heat        float32 // W delivered by the HVAC
+	coolingCall bool
+	heatingCall bool
+}
+
+func newHVACZone(config config.HVACZone) *hvacZone {
+	return &hvacZone{
+		name:          config.Name,
+		thermalMass:   config.ThermalMass,
+		envelopeUA:    config.EnvelopeUA,
+		internalGains: config.InternalGains,
+		setpoint:      uint16(config.Setpoint * 10),
+		damper:        100,
+	}
+}
+
+// init sets the defaults of the zone, the defaults keep the room of the
+// configurations without a thermal model the room temperature offset above
+// the outside temperature
+func (z *hvacZone) init(outside float32, roomTempOffset float32, setpoint uint16) error {
+	if z.name == "" || strings.Contains(z.name, ".") {
+		return fmt.Errorf("HVAC zone name is empty or contains a dot: %q", z.name)
+	}
+
+	if z.thermalMass <= 0 {
+		z.thermalMass = 1000
+	}
+	if z.envelopeUA <= 0 {
+		z.envelopeUA = 100
+	}
+	if z.internalGains == 0 {
+		z.internalGains = z.envelopeUA * roomTempOffset
+	}
+	if z.setpoint == 0 {
+		z.setpoint = setpoint
+	}
+
+	z.temperature = outside + roomTempOffset
+	return nil
+}
+
+// thermostat calls for cooling or heating to hold the zone at its setpoint.
+// The cooling starts above the setpoint plus the deadband and the heating
+// below the setpoint minus the deadband, both stop once the zone is back at
+// the setpoint.
+func (z *hvacZone) thermostat(mode uint16, deadband float32) {
+	setpoint := float32(z.setpoint) / 10
+	cooling := mode == hvacModeAuto || mode == hvacModeCool
+	heating := mode == hvacModeAuto || mode == hvacModeHeat
+
+	if cooling && z.temperature > setpoint+deadband {
+		z.coolingCall = true
+	} else if z.temperature <= setpoint || !cooling {
+		z.coolingCall = false
+	}
+
+	if heating && z.temperature < setpoint-deadband {
+		z.heatingCall = true
+	} else if z.temperature >= setpoint || !heating {
+		z.heatingCall = false
+	}
+}
+
+// update runs the first order thermal model of the zone over the one second tick
+func (z *hvacZone) update(outside float32) {
+	heat := z.envelopeUA*(outside-z.temperature) + z.internalGains + z.heat
+	z.temperature += heat / (z.thermalMass * 1000)
+	log.Debugf("HVAC Zone %v: Temperature: %v, Damper: %v, Heat: %v", z.name, z.temperature, z.damper, z.heat)
+}
+
+// zone returns the zone and the offset within its block for the given address
+func (h *HVACHandler) zone(addr uint16) (*hvacZone, uint16, bool) {
+	if !h.zoned || addr < h.zoneBase {
+		return nil, 0, false
+	}
+	index := int(addr-h.zoneBase) / int(h.zoneStride)
+	offset := (addr - h.zoneBase) % h.zoneStride
+	if index >= len(h.zones) || offset >= zoneRegisters {
+		return nil, 0, false
+	}
+	return h.zones[index], offset, true
+}
+
+// discreteInput returns the value of the zone discrete input at the given offset
+func (z *hvacZone) discreteInput(offset uint16) (bool, bool) {
+	switch offset {
+	case zoneCoolingCallReg:
+		return z.coolingCall, true
+	case zoneHeatingCallReg:
+		return z.heatingCall, true
+	}
+	return false, false
+}
+
+// holdingRegister returns the zone holding register at the given offset and its range
+func (z *hvacZone) holdingRegister(offset uint16) (*uint16, uint16, uint16) {
+	switch offset {
+	case zoneSetpointReg:
+		// the thermostat accepts setpoints between 5 and 35 C
+		return &z.setpoint, 50, 350
+	case zoneDamperReg:
+		return &z.damper, 0, 100
+	}
+	return nil, 0, 0
+}
+
+// inputRegister returns the float32 zone input register starting at the given offset
+func (z *hvacZone) inputRegister(offset uint16) (float32, bool) {
+	switch offset {
+	case zoneTemperatureReg:
+		return z.temperature, true
+	case zoneAirflowReg:
+		return z.airflow, true
+	case zoneHeatReg:
+		return z.heat, true
+	}
+	return 0, false
+}
@@ -0,0 +1,739 @@
+package handler
+
+/*
+* This file contains the handler for the hydraulic network simulation. The
+* network is made of tanks at different elevations connected by pipes. A pipe
+* can have a pump, described by its head/flow curve, and a control valve,
+* described by its Cv. The flow in each pipe follows the rigid water column
+* equation: the water accelerates with the difference between the heads at
+* both ends and the pump head, less the friction and valve losses. The tank
+* levels integrate the pipe flows, so starting a pump or slamming a valve
+* shows a realistic transient instead of a step.
+ */
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+// The registers of the tanks and the pipes are laid out in blocks of ten
+// addresses, the first tank at 100, the second at 110, and so on. The first
+// pipe is at 200.
+const (
+	hydraulicsTankBase  = 100
+	hydraulicsPipeBase  = 200
+	hydraulicsBlockSize = 10
+	// the number of tanks and pipes fitting in the register map
+	hydraulicsMaxTanks = 10
+	hydraulicsMaxPipes = 10
+)
+
+// Offsets within a tank block
+const (
+	// Discrete Inputs (Read-Only)
+	hydraulicsLowAlarmReg    = 0
+	hydraulicsHighAlarmReg   = 1
+	hydraulicsOverflowingReg = 2
+	hydraulicsEmptyReg       = 3
+
+	// Holding Registers (Read/Write)
+	hydraulicsDemandReg = 0 // 0.1 L/s
+
+	// Input Registers (Read-Only)
+	hydraulicsLevelReg        = 0 // m
+	hydraulicsLevelPercentReg = 2 // %
+	hydraulicsVolumeReg       = 4 // m3
+	hydraulicsNetInflowReg    = 6 // L/s
+	hydraulicsHeadReg         = 8 // m
+)
+
+// Offsets within a pipe block
+const (
+	// Coils
+	hydraulicsPumpRunReg = 0
+
+	// Discrete Inputs (Read-Only)
+	hydraulicsPumpRunningReg = 0
+	hydraulicsReverseFlowReg = 1
+
+	// Holding Registers (Read/Write)
+	hydraulicsPumpSpeedReg     = 0 // %
+	hydraulicsValvePositionReg = 1 // %
+
+	// Input Registers (Read-Only)
+	hydraulicsFlowReg      = 0 // L/s
+	hydraulicsVelocityReg  = 2 // m/s
+	hydraulicsHeadLossReg  = 4 // m
+	hydraulicsPumpHeadReg  = 6 // m
+	hydraulicsPumpPowerReg = 8 // kW
+)
+
+const (
+	gravity          = 9.81   // m/s2
+	waterDensity     = 1000   // kg/m3
+	waterViscosity   = 1.0e-6 // m2/s, kinematic
+	psiToMeters      = 0.70307
+	cubicMetersToGPM = 15850.3
+	// the flows are integrated in steps shorter than the one second tick
+	hydraulicsSteps = 10
+	// the pumps reach full speed in five seconds
+	hydraulicsPumpRamp = 0.2 // per second
+	// rangeability of the equal percentage valves
+	valveRangeability = 50
+	// a centrifugal pump still draws this fraction of its rated power at shutoff
+	pumpShutoffPower = 0.45
+	// the demand register holds up to 6553.5 L/s
+	hydraulicsMaxDemand = math.MaxUint16 / 10.0
+	// the flow is laminar below the first Reynolds number and turbulent above the second
+	laminarReynolds   = 2000
+	turbulentReynolds = 4000
+)
+
+type hydraulicTank struct {
+	name      string
+	elevation float32 // m, bottom of the tank
+	area      float32 // m2
+	height    float32 // m
+	lowAlarm  float32 // m
+	highAlarm float32 // m
+
+	demandFlow float32 // L/s
+	demand     uint16  // 0.1 L/s
+
+	volume      float32 // m3
+	inflow      float32 // L/s, from the topology
+	netInflow   float32 // L/s
+	overflowing bool
+	empty       bool
+
+	// flows of the current step, m3/s
+	in  float32
+	out float32
+	// fraction of the outgoing flows the tank can supply during the current step
+	supply float32
+}
+
+// level returns the water level in m
+func (t *hydraulicTank) level() float32 {
+	return t.volume / t.area
+}
+
+// head returns the hydraulic head at the bottom of the tank in m
+func (t *hydraulicTank) head() float32 {
+	return t.elevation + t.level()
+}
+
+type hydraulicPipe struct {
+	name      string
+	fromName  string
+	toName    string
+	from      *hydraulicTank
+	to        *hydraulicTank
+	length    float32 // m
+	diameter  float32 // m
+	roughness float32 // m
+	minorLoss float32
+
+	pump            bool
+	shutoffHead     float32 // m
+	maxFlow         float32 // m3/s
+	efficiency      float32
+	valve           bool
+	valveCv         float32
+	characteristic  string
+	equalPercentage bool
+
+	run      bool
+	speed    uint16 // %
+	position uint16 // %
+
+	actualSpeed float32 // fraction of the rated speed
+	flow        float32 // m3/s, positive from the from tank to the to tank
+	headLoss    float32 // m
+	pumpHead    float32 // m
+	power       float32 // kW
+}
+
+// crossSection returns the inner cross section of the pipe in m2
+func (p *hydraulicPipe) crossSection() float32 {
+	return math.Pi * p.diameter * p.diameter / 4
+}
+
+// frictionFactor returns the Darcy friction factor, laminar or from the Swamee-Jain
+// equation, and interpolated between the two through the transition
+func frictionFactor(reynolds float64, relativeRoughness float64) float64 {
+	reynolds = max(reynolds, 1)
+	turbulent := func(reynolds float64) float64 {
+		return 0.25 / math.Pow(math.Log10(relativeRoughness/3.7+5.74/math.Pow(reynolds, 0.9)), 2)
+	}
+
+	switch {
+	case reynolds <= laminarReynolds:
+		return 64 / reynolds
+	case reynolds >= turbulentReynolds:
+		return turbulent(reynolds)
+	}
+	x := (reynolds - laminarReynolds) / (turbulentReynolds - laminarReynolds)
+	return (1-x)*64/laminarReynolds + x*turbulent(turbulentReynolds)
+}
+
+// openCv returns the flow coefficient of the valve at its current position
+func (p *hydraulicPipe) openCv() float32 {
+	x := float32(p.position) / 100
+	if x <= 0 {
+		return 0
+	}
+	if p.equalPercentage {
+		return p.valveCv * float32(math.Pow(valveRangeability, float64(x-1)))
+	}
+	return p.valveCv * x
+}
+
+// resistance returns the coefficient of the losses in m/(m3/s)2 at the given flow
+func (p *hydraulicPipe) resistance(flow float32) float32 {
+	area := p.crossSection()
+	velocity := math.Abs(float64(flow / area))
+	friction := frictionFactor(velocity*float64(p.diameter)/waterViscosity, float64(p.roughness/p.diameter))
+
+	k := (float32(friction)*p.length/p.diameter + p.minorLoss) / (2 * gravity * area * area)
+	if cv := p.openCv(); p.valve && cv > 0 {
+		k += psiToMeters * (cubicMetersToGPM / cv) * (cubicMetersToGPM / cv)
+	}
+	if p.pump {
+		// the pump curve drops with the square of the flow
+		k += p.shutoffHead / (p.maxFlow * p.maxFlow)
+	}
+	return k
+}
+
+// step advances the flow of the pipe by dt seconds
+func (p *hydraulicPipe) step(dt float32) {
+	// the pump speed ramps towards the commanded speed
+	target := float32(0)
+	if p.run {
+		target = float32(p.speed) / 100
+	}
+	if p.actualSpeed < target {
+		p.actualSpeed = min(target, p.actualSpeed+hydraulicsPumpRamp*dt)
+	} else {
+		p.actualSpeed = max(target, p.actualSpeed-hydraulicsPumpRamp*dt)
+	}
+
+	if p.valve && p.openCv() <= 0 {
+		// a closed valve stops the flow
+		p.flow = 0
+		return
+	}
+
+	drive := p.from.head() - p.to.head()
+	if p.pump {
+		// affinity laws, the shutoff head grows with the square of the speed
+		drive += p.shutoffHead * p.actualSpeed * p.actualSpeed
+	}
+
+	// rigid water column, the losses are taken implicitly to keep the
+	// integration stable when a valve is nearly closed
+	inertance := gravity * p.crossSection() / p.length
+	k := p.resistance(p.flow)
+	p.flow = (p.flow + dt*inertance*drive) / (1 + dt*inertance*k*float32(math.Abs(float64(p.flow))))
+
+	// the pumps have a check valve
+	if p.pump && p.flow < 0 {
+		p.flow = 0
+	}
+}
+
+// source returns the tank the water of the pipe is drawn from
+func (p *hydraulicPipe) source() *hydraulicTank {
+	if p.flow < 0 {
+		return p.to
+	}
+	return p.from
+}
+
+// report updates the values of the pipe shown in the registers
+func (p *hydraulicPipe) report() {
+	k := p.resistance(p.flow)
+	p.pumpHead = 0
+	p.power = 0
+	if p.pump {
+		pumpK := p.shutoffHead / (p.maxFlow * p.maxFlow)
+		k -= pumpK
+		if p.actualSpeed > 0 {
+			p.pumpHead = p.shutoffHead*p.actualSpeed*p.actualSpeed - pumpK*p.flow*p.flow
+
+			// the power grows linearly with the flow, from its shutoff value
+			// up to the rated power at the best efficiency point
+			bestFlow := p.maxFlow / math.Sqrt2
+			rated := waterDensity * gravity * bestFlow * p.shutoffHead / 2 / p.efficiency / 1000
+			x := p.flow / (bestFlow * p.actualSpeed)
+			p.power = rated * p.actualSpeed * p.actualSpeed * p.actualSpeed * (pumpShutoffPower + (1-pumpShutoffPower)*x)
+		}
+	}
+	p.headLoss = k * p.flow * p.flow
+}
+
+type HydraulicsHandler struct {
+	Lock sync.RWMutex
+
+	tanks []*hydraulicTank
+	pipes []*hydraulicPipe
+	names map[string]any
+}
+
+func NewHydraulicsHandler(config config.Hydraulics) *HydraulicsHandler {
+	h := &HydraulicsHandler{names: make(map[string]any)}
+
+	for _, c := range config.Tanks {
+		t := &hydraulicTank{
+			name:       c.Name,
+			elevation:  c.Elevation,
+			area:       c.Area,
+			height:     c.Height,
+			lowAlarm:   c.LowAlarm,
+			highAlarm:  c.HighAlarm,
+			demandFlow: c.Demand,
+			volume:     c.Area * c.InitialLevel,
+		}
+		h.tanks = append(h.tanks, t)
+		if _, ok := h.names[c.Name]; !ok {
+			h.names[c.Name] = t
+		}
+	}
+
+	for _, c := range config.Pipes {
+		p := &hydraulicPipe{
+			name:           c.Name,
+			fromName:       c.From,
+			toName:         c.To,
+			length:         c.Length,
+			diameter:       c.Diameter,
+			roughness:      c.Roughness / 1000,
+			minorLoss:      c.MinorLoss,
+			pump:           c.PumpShutoffHead > 0,
+			shutoffHead:    c.PumpShutoffHead,
+			maxFlow:        c.PumpMaxFlow / 1000,
+			efficiency:     c.PumpEfficiency,
+			valve:          c.ValveCv > 0,
+			valveCv:        c.ValveCv,
+			characteristic: c.ValveCharacteristic,
+		}
+		h.pipes = append(h.pipes, p)
+		if _, ok := h.names[c.Name]; !ok {
+			h.names[c.Name] = p
+		}
+	}
+
+	return h
+}
+
+func (h *HydraulicsHandler) Init() error {
+	if len(h.tanks) == 0 {
+		return fmt.Errorf("hydraulic network has no tank")
+	}
+	if len(h.tanks) > hydraulicsMaxTanks || len(h.pipes) > hydraulicsMaxPipes {
+		return fmt.Errorf("hydraulic network supports up to %v tanks and %v pipes", hydraulicsMaxTanks, hydraulicsMaxPipes)
+	}
+	if len(h.names) != len(h.tanks)+len(h.pipes) {
+		return fmt.Errorf("hydraulic network tank and pipe names must be unique")
+	}
+
+	for _, t := range h.tanks {
+		if t.name == "" || strings.Contains(t.name, ".") {
+			return fmt.Errorf("hydraulic tank name is empty or contains a dot: %q", t.name)
+		}
+		if t.area <= 0 || t.height <= 0 {
+			return fmt.Errorf("hydraulic tank %v must have an area and a height", t.name)
+		}
+		if t.level() > t.height || t.volume < 0 {
+			return fmt.Errorf("hydraulic tank %v initial level is outside of the tank", t.name)
+		}
+		if t.demandFlow < 0 || t.demandFlow > hydraulicsMaxDemand {
+			return fmt.Errorf("hydraulic tank %v demand must be between 0 and %v L/s", t.name, hydraulicsMaxDemand)
+		}
+		t.demand = uint16(math.Round(float64(t.demandFlow) * 10))
+	}
+
+	for _, p := range h.pipes {
+		if p.name == "" || strings.Contains(p.name, ".") {
+			return fmt.Errorf("hydraulic pipe name is empty or contains a dot: %q", p.name)
+		}
+
+		from, ok := h.names[p.fromName].(*hydraulicTank)
+		if !ok {
+			return fmt.Errorf("hydraulic pipe %v from an unknown tank: %v", p.name, p.fromName)
+		}
+		to, ok := h.names[p.toName].(*hydraulicTank)
+		if !ok {
+			return fmt.Errorf("hydraulic pipe %v to an unknown tank: %v", p.name, p.toName)
+		}
+		if from == to {
+			return fmt.Errorf("hydraulic pipe %v connects a tank to itself", p.name)
+		}
+		p.from, p.to = from, to
+
+		if p.length <= 0 || p.diameter <= 0 {
+			return fmt.Errorf("hydraulic pipe %v must have a length and a diameter", p.name)
+		}
+		if p.pump && p.maxFlow <= 0 {
+			return fmt.Errorf("hydraulic pipe %v pump must have a max flow", p.name)
+		}
+		if p.efficiency <= 0 || p.efficiency > 1 {
+			p.efficiency = 0.7
+		}
+		switch p.characteristic {
+		case "", "linear":
+			p.equalPercentage = false
+		case "equal_percentage":
+			p.equalPercentage = true
+		default:
+			return fmt.Errorf("hydraulic pipe %v has an unknown valve characteristic: %v", p.name, p.characteristic)
+		}
+
+		p.run = false
+		p.speed = 100
+		p.position = 100
+	}
+
+	return nil
+}
+
+// Power returns the power drawn by the pumps in W
+func (h *HydraulicsHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	var power float32
+	for _, p := range h.pipes {
+		power += p.power
+	}
+	return power * 1000
+}
+
+// SetInput sets the named topology input: the inflow of a tank in L/s
+// ("tank.inflow"), or the pump speed or the valve position of a pipe in
+// percent ("pipe.speed" or "pipe.valve")
+func (h *HydraulicsHandler) SetInput(port string, value float32) bool {
+	name, input, _ := strings.Cut(port, ".")
+
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	percent := uint16(max(0, min(100, value)) + 0.5)
+	switch e := h.names[name].(type) {
+	case *hydraulicTank:
+		if input == "inflow" {
+			e.inflow = value
+			return true
+		}
+	case *hydraulicPipe:
+		switch input {
+		case "speed":
+			e.speed = percent
+			return true
+		case "valve":
+			e.position = percent
+			return true
+		}
+	}
+	return false
+}
+
+// Output returns the value of the named topology output: the power drawn by
+// the pumps in W, the level of a tank in percent ("tank.level") or the flow
+// of a pipe in L/s ("pipe.flow")
+func (h *HydraulicsHandler) Output(port string) (float32, bool) {
+	if port == "power" {
+		return h.Power(), true
+	}
+
+	name, output, _ := strings.Cut(port, ".")
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	switch e := h.names[name].(type) {
+	case *hydraulicTank:
+		if output == "level" {
+			return e.level() / e.height * 100, true
+		}
+	case *hydraulicPipe:
+		if output == "flow" {
+			return e.flow * 1000, true
+		}
+	}
+	return 0, false
+}
+
+func (h *HydraulicsHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	dt := float32(1) / hydraulicsSteps
+	volumes := make([]float32, len(h.tanks))
+	for i, t := range h.tanks {
+		volumes[i] = t.volume
+		t.overflowing = false
+	}
+
+	for step := 0; step < hydraulicsSteps; step++ {
+		for _, p := range h.pipes {
+			p.step(dt)
+		}
+
+		// the flows leaving each tank are limited to the water it holds
+		for _, t := range h.tanks {
+			t.in = t.inflow / 1000
+			t.out = float32(t.demand) / 10000
+		}
+		for _, p := range h.pipes {
+			if p.flow > 0 {
+				p.from.out += p.flow
+				p.to.in += p.flow
+			} else {
+				p.to.out -= p.flow
+				p.from.in -= p.flow
+			}
+		}
+		for _, t := range h.tanks {
+			t.supply = 1
+			if t.out*dt > t.volume+t.in*dt {
+				t.supply = max(0, t.volume+t.in*dt) / (t.out * dt)
+			}
+		}
+		for _, p := range h.pipes {
+			p.flow *= p.source().supply
+			p.from.volume -= p.flow * dt
+			p.to.volume += p.flow * dt
+		}
+
+		for _, t := range h.tanks {
+			t.volume += (t.inflow/1000 - float32(t.demand)/10000*t.supply) * dt
+			t.volume = max(0, t.volume)
+
+			// the excess water spills over the top of the tank
+			if t.volume > t.area*t.height {
+				t.volume = t.area * t.height
+				t.overflowing = true
+			}
+		}
+	}
+
+	for i, t := range h.tanks {
+		t.netInflow = (t.volume - volumes[i]) * 1000
+		t.empty = t.volume <= 0
+		log.Debugf("Hydraulics Tank %v: Level: %v, Net Inflow: %v", t.name, t.level(), t.netInflow)
+	}
+	for _, p := range h.pipes {
+		p.report()
+		log.Debugf("Hydraulics Pipe %v: Flow: %v, Pump Head: %v, Head Loss: %v", p.name, p.flow*1000, p.pumpHead, p.headLoss)
+	}
+
+	return nil
+}
+
+// hydraulicsBlock returns the index of the tank or pipe and the offset within its block for the given address
+func hydraulicsBlock(addr uint16, base uint16, count int) (int, uint16, bool) {
+	if addr < base || int(addr-base) >= count*hydraulicsBlockSize {
+		return 0, 0, false
+	}
+	return int(addr-base) / hydraulicsBlockSize, (addr - base) % hydraulicsBlockSize, true
+}
+
+// discreteInput returns the value of the discrete input at the given address
+func (h *HydraulicsHandler) discreteInput(addr uint16) (bool, bool) {
+	if i, offset, ok := hydraulicsBlock(addr, hydraulicsTankBase, len(h.tanks)); ok {
+		t := h.tanks[i]
+		level := t.level()
+		switch offset {
+		case hydraulicsLowAlarmReg:
+			return t.lowAlarm > 0 && level <= t.lowAlarm, true
+		case hydraulicsHighAlarmReg:
+			return t.highAlarm > 0 && level >= t.highAlarm, true
+		case hydraulicsOverflowingReg:
+			return t.overflowing, true
+		case hydraulicsEmptyReg:
+			return t.empty, true
+		}
+	}
+
+	if i, offset, ok := hydraulicsBlock(addr, hydraulicsPipeBase, len(h.pipes)); ok {
+		p := h.pipes[i]
+		switch offset {
+		case hydraulicsPumpRunningReg:
+			return p.actualSpeed > 0, true
+		case hydraulicsReverseFlowReg:
+			return p.flow < 0, true
+		}
+	}
+
+	return false, false
+}
+
+// holdingRegister returns the holding register at the given address and its maximum value
+func (h *HydraulicsHandler) holdingRegister(addr uint16) (*uint16, uint16) {
+	if i, offset, ok := hydraulicsBlock(addr, hydraulicsTankBase, len(h.tanks)); ok && offset == hydraulicsDemandReg {
+		return &h.tanks[i].demand, math.MaxUint16
+	}
+
+	if i, offset, ok := hydraulicsBlock(addr, hydraulicsPipeBase, len(h.pipes)); ok {
+		switch offset {
+		case hydraulicsPumpSpeedReg:
+			return &h.pipes[i].speed, 100
+		case hydraulicsValvePositionReg:
+			return &h.pipes[i].position, 100
+		}
+	}
+
+	return nil, 0
+}
+
+// inputRegister returns the value of the float32 input register starting at the given address
+func (h *HydraulicsHandler) inputRegister(addr uint16) (float32, bool) {
+	if i, offset, ok := hydraulicsBlock(addr, hydraulicsTankBase, len(h.tanks)); ok {
+		t := h.tanks[i]
+		switch offset {
+		case hydraulicsLevelReg:
+			return t.level(), true
+		case hydraulicsLevelPercentReg:
+			return t.level() / t.height * 100, true
+		case hydraulicsVolumeReg:
+			return t.volume, true
+		case hydraulicsNetInflowReg:
+			return t.netInflow, true
+		case hydraulicsHeadReg:
+			return t.head(), true
+		}
+	}
+
+	if i, offset, ok := hydraulicsBlock(addr, hydraulicsPipeBase, len(h.pipes)); ok {
+		p := h.pipes[i]
+		switch offset {
+		case hydraulicsFlowReg:
+			return p.flow * 1000, true
+		case hydraulicsVelocityReg:
+			return p.flow / p.crossSection(), true
+		case hydraulicsHeadLossReg:
+			return p.headLoss, true
+		case hydraulicsPumpHeadReg:
+			return p.pumpHead, true
+		case hydraulicsPumpPowerReg:
+			return p.power, true
+		}
+	}
+
+	return 0, false
+}
+
+func (h *HydraulicsHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr := req.Addr + uint16(i)
+
+		// the only coils are the pump run commands
+		index, offset, ok := hydraulicsBlock(regAddr, hydraulicsPipeBase, len(h.pipes))
+		if !ok || offset != hydraulicsPumpRunReg {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.pipes[index].run = req.Args[i]
+		}
+		res = append(res, h.pipes[index].run)
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *HydraulicsHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr := req.Addr + uint16(i)
+
+		value, ok := h.discreteInput(regAddr)
+		if !ok {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+		res = append(res, value)
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *HydraulicsHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		value, maxValue := h.holdingRegister(regAddr)
+		if value == nil {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+
+		if req.IsWrite {
+			if req.Args[i] > maxValue {
+				err = modbus.ErrIllegalDataValue
+				log.Warnf("Illegal data value: %v", req.Args[i])
+				return
+			}
+			*value = req.Args[i]
+		}
+		res = append(res, *value)
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *HydraulicsHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		// every value is a float32 starting at an even address
+		value, ok := h.inputRegister(regAddr &^ 1)
+		if !ok {
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+
+		if regAddr%2 == 0 {
+			res = append(res, uint16((math.Float32bits(value)>>16)&0xffff))
+		} else {
+			res = append(res, uint16((math.Float32bits(value))&0xffff))
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFrictionFactor(t *testing.T) {
+	// the turbulent values are within 1% of the Colebrook equation
+	tests := []struct {
+		name              string
+		reynolds          float64
+		relativeRoughness float64
+		want              float64
+	}{
+		{"no flow", 0, 0, 64},
+		{"laminar", 1000, 0, 0.064},
+		{"laminar limit", 2000, 0, 0.032},
+		{"transition", 3000, 0.001, 0.03685},
+		{"turbulent limit", 4000, 0.001, 0.04170},
+		{"smooth pipe", 1e5, 0, 0.01786},
+		{"commercial steel", 1e5, 1e-4, 0.01845},
+		{"rough pipe", 1e6, 0.001, 0.02003},
+		{"fully rough", 1e7, 0.05, 0.07156},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := frictionFactor(tt.reynolds, tt.relativeRoughness)
+			if math.Abs(got-tt.want) > 1e-3*tt.want {
+				t.Errorf("frictionFactor(%v, %v) = %v, want %v", tt.reynolds, tt.relativeRoughness, got, tt.want)
+			}
+		})
+	}
+}
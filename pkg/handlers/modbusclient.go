@@ -0,0 +1,444 @@
+package handler
+
+/*
+* This file contains the handler for the Modbus client (master) device.
+* The device polls registers from a remote Modbus server (another
+* ICSSimSuite instance or a real PLC) and mirrors them into its own
+* coils, discrete inputs, holding registers and input registers.
+* Writes to mirrored coils and holding registers are forwarded to the
+* remote server on the next poll.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mappingCoil            = "coil"
+	mappingDiscreteInput   = "discrete_input"
+	mappingHoldingRegister = "holding_register"
+	mappingInputRegister   = "input_register"
+
+	// the most coils and registers a single read or write request carries
+	modbusMaxReadCoils      = 2000
+	modbusMaxReadRegisters  = 125
+	modbusMaxWriteCoils     = 1968
+	modbusMaxWriteRegisters = 123
+)
+
+// modbusExceptions are the errors of a remote server answering with an
+// exception, the connection is fine but the request will not succeed if retried
+var modbusExceptions = []error{
+	modbus.ErrIllegalFunction,
+	modbus.ErrIllegalDataAddress,
+	modbus.ErrIllegalDataValue,
+	modbus.ErrServerDeviceFailure,
+	modbus.ErrAcknowledge,
+	modbus.ErrServerDeviceBusy,
+	modbus.ErrMemoryParityError,
+	modbus.ErrGWPathUnavailable,
+	modbus.ErrGWTargetFailedToRespond,
+}
+
+// isException reports whether the error is an exception of the remote server
+func isException(err error) bool {
+	for _, e := range modbusExceptions {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+type modbusClientMapping struct {
+	kind       string
+	remoteAddr uint16
+	localAddr  uint16
+	quantity   uint16
+
+	bits   []bool
+	values []uint16
+}
+
+// contains reports whether the local address is covered by the mapping
+func (m *modbusClientMapping) contains(addr uint16) bool {
+	return addr >= m.localAddr && int(addr) < int(m.localAddr)+int(m.quantity)
+}
+
+// overlaps reports whether the local addresses of both mappings of the same kind overlap
+func (m *modbusClientMapping) overlaps(other *modbusClientMapping) bool {
+	return m.kind == other.kind &&
+		int(m.localAddr) < int(other.localAddr)+int(other.quantity) &&
+		int(other.localAddr) < int(m.localAddr)+int(m.quantity)
+}
+
+type ModbusClientHandler struct {
+	Lock sync.RWMutex
+
+	url          string
+	unitId       uint8
+	pollInterval uint
+	timeout      time.Duration
+
+	client    *modbus.ModbusClient
+	connected bool
+	polling   bool
+	ticks     uint
+
+	mappings []*modbusClientMapping
+
+	// writes received from local clients, keyed by remote address,
+	// waiting to be forwarded to the remote server
+	pendingCoils     map[uint16]bool
+	pendingRegisters map[uint16]uint16
+}
+
+func NewModbusClientHandler(config config.ModbusClient) *ModbusClientHandler {
+	h := &ModbusClientHandler{
+		url:              config.URL,
+		unitId:           config.UnitId,
+		pollInterval:     config.PollInterval,
+		timeout:          time.Duration(config.Timeout) * time.Second,
+		pendingCoils:     make(map[uint16]bool),
+		pendingRegisters: make(map[uint16]uint16),
+	}
+
+	for _, m := range config.Mappings {
+		h.mappings = append(h.mappings, &modbusClientMapping{
+			kind:       m.Type,
+			remoteAddr: m.RemoteAddr,
+			localAddr:  m.LocalAddr,
+			quantity:   m.Quantity,
+		})
+	}
+
+	return h
+}
+
+func (h *ModbusClientHandler) Init() error {
+	if h.pollInterval == 0 {
+		h.pollInterval = 1
+	}
+	if h.timeout == 0 {
+		h.timeout = 1 * time.Second
+	}
+	if h.unitId == 0 {
+		h.unitId = 1
+	}
+
+	// a mapping the remote server cannot answer in a single read would fail every poll
+	for i, m := range h.mappings {
+		var maxQuantity uint16
+		switch m.kind {
+		case mappingCoil, mappingDiscreteInput:
+			m.bits = make([]bool, m.quantity)
+			maxQuantity = modbusMaxReadCoils
+		case mappingHoldingRegister, mappingInputRegister:
+			m.values = make([]uint16, m.quantity)
+			maxQuantity = modbusMaxReadRegisters
+		default:
+			return fmt.Errorf("unknown modbus client mapping type: %v", m.kind)
+		}
+
+		if m.quantity == 0 || m.quantity > maxQuantity {
+			return fmt.Errorf("modbus client %v mapping at %v must have a quantity of 1 to %v", m.kind, m.localAddr, maxQuantity)
+		}
+		if int(m.localAddr)+int(m.quantity) > math.MaxUint16+1 || int(m.remoteAddr)+int(m.quantity) > math.MaxUint16+1 {
+			return fmt.Errorf("modbus client %v mapping at %v runs past the last address", m.kind, m.localAddr)
+		}
+		for _, other := range h.mappings[:i] {
+			if m.overlaps(other) {
+				return fmt.Errorf("modbus client %v mappings at %v and %v overlap", m.kind, other.localAddr, m.localAddr)
+			}
+		}
+	}
+
+	client, err := modbus.NewClient(&modbus.ClientConfiguration{
+		URL:     h.url,
+		Timeout: h.timeout,
+	})
+	if err != nil {
+		return err
+	}
+	client.SetUnitId(h.unitId)
+	h.client = client
+
+	return nil
+}
+
+func (h *ModbusClientHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	h.ticks++
+	if h.ticks%h.pollInterval != 0 {
+		return nil
+	}
+
+	// the poll runs in its own goroutine so a slow or unreachable remote
+	// server never stalls the simulation ticker
+	if h.polling {
+		log.Debugf("Modbus client: previous poll still running, skipping")
+		return nil
+	}
+	h.polling = true
+
+	coils := h.pendingCoils
+	registers := h.pendingRegisters
+	h.pendingCoils = make(map[uint16]bool)
+	h.pendingRegisters = make(map[uint16]uint16)
+
+	go h.poll(coils, registers)
+
+	return nil
+}
+
+// poll forwards the pending writes and reads every mapping from the remote server
+func (h *ModbusClientHandler) poll(coils map[uint16]bool, registers map[uint16]uint16) {
+	defer func() {
+		h.Lock.Lock()
+		h.polling = false
+		h.Lock.Unlock()
+	}()
+
+	if !h.connected {
+		if err := h.client.Open(); err != nil {
+			log.Errorf("Modbus client: failed to connect to %v: %v", h.url, err)
+			h.requeue(coils, registers)
+			return
+		}
+		log.Infof("Modbus client: connected to %v", h.url)
+		h.connected = true
+	}
+
+	// the writes are forwarded in address order, a run of contiguous
+	// addresses in a single request so e.g. a float32 is written at once
+	for _, run := range writeRuns(coils, modbusMaxWriteCoils) {
+		values := make([]bool, len(run))
+		for i, addr := range run {
+			values[i] = coils[addr]
+		}
+		// a write the remote rejects is dropped, retrying it would block the queue for good
+		err := h.client.WriteCoils(run[0], values)
+		if err != nil && isException(err) {
+			log.Warnf("Modbus client: write of coils %v+%v rejected: %v", run[0], len(run), err)
+		} else if err != nil {
+			h.requeue(coils, registers)
+			h.disconnect(err)
+			return
+		}
+		for _, addr := range run {
+			delete(coils, addr)
+		}
+	}
+
+	for _, run := range writeRuns(registers, modbusMaxWriteRegisters) {
+		values := make([]uint16, len(run))
+		for i, addr := range run {
+			values[i] = registers[addr]
+		}
+		err := h.client.WriteRegisters(run[0], values)
+		if err != nil && isException(err) {
+			log.Warnf("Modbus client: write of registers %v+%v rejected: %v", run[0], len(run), err)
+		} else if err != nil {
+			h.requeue(coils, registers)
+			h.disconnect(err)
+			return
+		}
+		for _, addr := range run {
+			delete(registers, addr)
+		}
+	}
+
+	for _, m := range h.mappings {
+		var bits []bool
+		var values []uint16
+		var err error
+
+		switch m.kind {
+		case mappingCoil:
+			bits, err = h.client.ReadCoils(m.remoteAddr, m.quantity)
+		case mappingDiscreteInput:
+			bits, err = h.client.ReadDiscreteInputs(m.remoteAddr, m.quantity)
+		case mappingHoldingRegister:
+			values, err = h.client.ReadRegisters(m.remoteAddr, m.quantity, modbus.HOLDING_REGISTER)
+		case mappingInputRegister:
+			values, err = h.client.ReadRegisters(m.remoteAddr, m.quantity, modbus.INPUT_REGISTER)
+		}
+		// a read the remote rejects leaves the mapping stale, the other mappings are still read
+		if err != nil && isException(err) {
+			log.Warnf("Modbus client: read of %v %v+%v rejected: %v", m.kind, m.remoteAddr, m.quantity, err)
+			continue
+		} else if err != nil {
+			h.disconnect(err)
+			return
+		}
+
+		h.Lock.Lock()
+		copy(m.bits, bits)
+		copy(m.values, values)
+		h.Lock.Unlock()
+
+		log.Debugf("Modbus client: %v %v+%v: %v%v", m.kind, m.remoteAddr, m.quantity, bits, values)
+	}
+}
+
+// writeRuns returns the addresses of the pending writes sorted and split into
+// runs of contiguous addresses, each run at most size long
+func writeRuns[V any](pending map[uint16]V, size int) [][]uint16 {
+	addrs := make([]uint16, 0, len(pending))
+	for addr := range pending {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+
+	var runs [][]uint16
+	for _, addr := range addrs {
+		if n := len(runs); n > 0 {
+			run := runs[n-1]
+			if run[len(run)-1]+1 == addr && len(run) < size {
+				runs[n-1] = append(run, addr)
+				continue
+			}
+		}
+		runs = append(runs, []uint16{addr})
+	}
+	return runs
+}
+
+// requeue puts the writes that were not forwarded back in the pending writes,
+// the writes received from local clients since take precedence
+func (h *ModbusClientHandler) requeue(coils map[uint16]bool, registers map[uint16]uint16) {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	for addr, value := range coils {
+		if _, ok := h.pendingCoils[addr]; !ok {
+			h.pendingCoils[addr] = value
+		}
+	}
+	for addr, value := range registers {
+		if _, ok := h.pendingRegisters[addr]; !ok {
+			h.pendingRegisters[addr] = value
+		}
+	}
+}
+
+// disconnect closes the connection so the next poll starts from a fresh one
+func (h *ModbusClientHandler) disconnect(err error) {
+	log.Errorf("Modbus client: %v", err)
+	h.client.Close()
+	h.connected = false
+}
+
+// lookup returns the mapping of the given kind that covers the local address
+func (h *ModbusClientHandler) lookup(kind string, addr uint16) *modbusClientMapping {
+	for _, m := range h.mappings {
+		if m.kind == kind && m.contains(addr) {
+			return m
+		}
+	}
+	return nil
+}
+
+func (h *ModbusClientHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		addr := req.Addr + uint16(i)
+		m := h.lookup(mappingCoil, addr)
+		if m == nil {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", addr)
+			return
+		}
+
+		offset := addr - m.localAddr
+		if req.IsWrite {
+			m.bits[offset] = req.Args[i]
+			h.pendingCoils[m.remoteAddr+offset] = req.Args[i]
+		}
+		res = append(res, m.bits[offset])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *ModbusClientHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		addr := req.Addr + uint16(i)
+		m := h.lookup(mappingDiscreteInput, addr)
+		if m == nil {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", addr)
+			return
+		}
+		res = append(res, m.bits[addr-m.localAddr])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *ModbusClientHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		addr := req.Addr + uint16(i)
+		m := h.lookup(mappingHoldingRegister, addr)
+		if m == nil {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", addr)
+			return
+		}
+
+		offset := addr - m.localAddr
+		if req.IsWrite {
+			m.values[offset] = req.Args[i]
+			h.pendingRegisters[m.remoteAddr+offset] = req.Args[i]
+		}
+		res = append(res, m.values[offset])
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *ModbusClientHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		m := h.lookup(mappingInputRegister, regAddr)
+		if m == nil {
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+		res = append(res, m.values[regAddr-m.localAddr])
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
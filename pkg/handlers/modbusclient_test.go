@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWriteRuns(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []uint16
+		size  int
+		want  [][]uint16
+	}{
+		{"none", nil, 123, nil},
+		{"single", []uint16{7}, 123, [][]uint16{{7}}},
+		{"contiguous", []uint16{3, 1, 2}, 123, [][]uint16{{1, 2, 3}}},
+		{"gap", []uint16{1, 2, 4, 5}, 123, [][]uint16{{1, 2}, {4, 5}}},
+		{"split at size", []uint16{0, 1, 2, 3, 4}, 2, [][]uint16{{0, 1}, {2, 3}, {4}}},
+		{"address ends", []uint16{0, 65534, 65535}, 123, [][]uint16{{0}, {65534, 65535}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pending := make(map[uint16]bool)
+			for _, addr := range tt.addrs {
+				pending[addr] = true
+			}
+			if got := writeRuns(pending, tt.size); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("writeRuns(%v, %v) = %v, want %v", tt.addrs, tt.size, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package handler
+
+/*
+* This file contains the handler for the PID controller simulation. The
+* controller runs independent loops, each one reading its process variable
+* from an output of another device and driving an input of another device
+* through the topology, e.g. the fan speed of the HVAC from the room
+* temperature, or the speed of a pump from the level of a tank. The loops
+* can be switched between auto and manual, with a bumpless transfer.
+ */
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+// The registers of the loops are laid out in blocks of twenty addresses,
+// the first loop at 100, the second at 120, and so on.
+const (
+	pidBase      = 100
+	pidBlockSize = 20
+	// the number of loops fitting in the register map
+	pidMaxLoops = 10
+)
+
+// Offsets within a loop block
+const (
+	// Discrete Inputs (Read-Only)
+	pidHighLimitReg = 0 // the output is held at its high limit
+	pidLowLimitReg  = 1 // the output is held at its low limit
+
+	// Holding Registers (Read/Write)
+	pidSetpointReg     = 0 // float32
+	pidKpReg           = 2 // float32
+	pidKiReg           = 4 // float32, 1/s
+	pidKdReg           = 6 // float32, s
+	pidManualOutputReg = 8 // float32
+	pidOutputMinReg    = 10
+	pidOutputMaxReg    = 12
+	pidModeReg         = 14 // uint16
+	pidActionReg       = 15 // uint16
+
+	// Input Registers (Read-Only)
+	pidProcessVariableReg = 0
+	pidOutputReg          = 2
+	pidErrorReg           = 4
+)
+
+// Loop modes
+const (
+	pidManual = 0
+	pidAuto   = 1
+)
+
+// Loop actions
+const (
+	pidReverseAction = 0 // the output rises when the process variable is below the setpoint, e.g. heating
+	pidDirectAction  = 1 // the output rises when the process variable is above the setpoint, e.g. cooling
+)
+
+// pidActions maps the loop actions of the configuration to their values
+var pidActions = map[string]uint16{
+	"":        pidReverseAction,
+	"reverse": pidReverseAction,
+	"direct":  pidDirectAction,
+}
+
+// pidController is a PID loop with its derivative on the process variable
+// and conditional integration against windup
+type pidController struct {
+	name string
+
+	setpoint     float32
+	kp           float32
+	ki           float32 // 1/s
+	kd           float32 // s
+	manualOutput float32
+	outputMin    float32
+	outputMax    float32
+	mode         uint16
+	action       uint16
+	actionName   string
+
+	input           float32 // process variable set by the topology
+	processVariable float32
+	previousPV      float32
+	started         bool
+	integral        float32
+	output          float32
+	error           float32
+}
+
+// update runs the loop for dt seconds with the given process variable
+func (c *pidController) update(processVariable float32, dt float32) {
+	sign := float32(1)
+	if c.action == pidDirectAction {
+		sign = -1
+	}
+
+	c.previousPV = c.processVariable
+	if !c.started {
+		c.previousPV = processVariable
+		c.started = true
+	}
+	c.processVariable = processVariable
+	c.error = sign * (c.setpoint - processVariable)
+	proportional := c.kp * c.error
+
+	if c.mode == pidManual {
+		// the integral tracks the manual output for a bumpless transfer to auto
+		c.output = max(c.outputMin, min(c.outputMax, c.manualOutput))
+		c.integral = c.output - proportional
+		return
+	}
+
+	// the derivative is taken on the process variable so a setpoint change does not kick the output
+	derivative := -sign * c.kd * (processVariable - c.previousPV) / dt
+
+	// the integral stops where it holds the output at a limit, so it does not wind
+	// up past it, nor stop short of it when a single step would overshoot the limit
+	integral := c.integral + c.ki*c.error*dt
+	if c.error > 0 {
+		integral = min(integral, max(c.integral, c.outputMax-proportional-derivative))
+	} else if c.error < 0 {
+		integral = max(integral, min(c.integral, c.outputMin-proportional-derivative))
+	}
+	c.integral = integral
+
+	c.output = max(c.outputMin, min(c.outputMax, proportional+c.integral+derivative))
+	// the manual output tracks the output for a bumpless transfer to manual
+	c.manualOutput = c.output
+}
+
+// value returns the float32 holding register starting at the given offset
+func (c *pidController) value(offset uint16) *float32 {
+	switch offset {
+	case pidSetpointReg:
+		return &c.setpoint
+	case pidKpReg:
+		return &c.kp
+	case pidKiReg:
+		return &c.ki
+	case pidKdReg:
+		return &c.kd
+	case pidManualOutputReg:
+		return &c.manualOutput
+	case pidOutputMinReg:
+		return &c.outputMin
+	case pidOutputMaxReg:
+		return &c.outputMax
+	}
+	return nil
+}
+
+type PIDHandler struct {
+	Lock sync.RWMutex
+
+	loops []*pidController
+	names map[string]*pidController
+}
+
+func NewPIDHandler(config config.PID) *PIDHandler {
+	h := &PIDHandler{names: make(map[string]*pidController)}
+
+	for _, c := range config.Loops {
+		loop := &pidController{
+			name:         c.Name,
+			setpoint:     c.Setpoint,
+			kp:           c.Kp,
+			ki:           c.Ki,
+			kd:           c.Kd,
+			manualOutput: c.ManualOutput,
+			outputMin:    c.OutputMin,
+			outputMax:    c.OutputMax,
+			mode:         pidAuto,
+			actionName:   c.Action,
+		}
+		if c.Manual {
+			loop.mode = pidManual
+		}
+		if loop.outputMin == 0 && loop.outputMax == 0 {
+			loop.outputMax = 100
+		}
+
+		h.loops = append(h.loops, loop)
+		if _, ok := h.names[c.Name]; !ok {
+			h.names[c.Name] = loop
+		}
+	}
+
+	return h
+}
+
+func (h *PIDHandler) Init() error {
+	if len(h.loops) == 0 || len(h.loops) > pidMaxLoops {
+		return fmt.Errorf("PID controller supports 1 to %v loops", pidMaxLoops)
+	}
+	if len(h.names) != len(h.loops) {
+		return fmt.Errorf("PID loop names must be unique")
+	}
+
+	for _, loop := range h.loops {
+		if loop.name == "" || strings.Contains(loop.name, ".") {
+			return fmt.Errorf("PID loop name is empty or contains a dot: %q", loop.name)
+		}
+		if loop.outputMin >= loop.outputMax {
+			return fmt.Errorf("PID loop %v output min must be below its output max", loop.name)
+		}
+		action, ok := pidActions[loop.actionName]
+		if !ok {
+			return fmt.Errorf("PID loop %v has an unknown action: %v", loop.name, loop.actionName)
+		}
+		loop.action = action
+	}
+
+	return nil
+}
+
+// SetInput sets the process variable of a loop, the port is written as "loop.pv"
+func (h *PIDHandler) SetInput(port string, value float32) bool {
+	name, input, _ := strings.Cut(port, ".")
+	loop, ok := h.names[name]
+	if !ok || input != "pv" {
+		return false
+	}
+
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+	loop.input = value
+	return true
+}
+
+// Output returns the output of a loop, the port is written as "loop.output"
+func (h *PIDHandler) Output(port string) (float32, bool) {
+	name, output, _ := strings.Cut(port, ".")
+	loop, ok := h.names[name]
+	if !ok || output != "output" {
+		return 0, false
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return loop.output, true
+}
+
+func (h *PIDHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	for _, loop := range h.loops {
+		loop.update(loop.input, 1)
+		log.Debugf("PID %v: PV: %v, SP: %v, Output: %v", loop.name, loop.processVariable, loop.setpoint, loop.output)
+	}
+
+	return nil
+}
+
+// loop returns the loop and the offset within its block for the given address
+func (h *PIDHandler) loop(addr uint16) (*pidController, uint16, bool) {
+	if addr < pidBase || int(addr-pidBase) >= len(h.loops)*pidBlockSize {
+		return nil, 0, false
+	}
+	return h.loops[(addr-pidBase)/pidBlockSize], (addr - pidBase) % pidBlockSize, true
+}
+
+func (h *PIDHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	err = modbus.ErrIllegalFunction
+	log.Warn("Illegal function: Coils")
+	return res, err
+}
+
+func (h *PIDHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		loop, offset, ok := h.loop(regAddr)
+		switch {
+		case ok && offset == pidHighLimitReg:
+			res = append(res, loop.mode == pidAuto && loop.output >= loop.outputMax)
+		case ok && offset == pidLowLimitReg:
+			res = append(res, loop.mode == pidAuto && loop.output <= loop.outputMin)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *PIDHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	// the high word of a float32 written along with its low word is held
+	// until the low word is applied, so the value is validated as a whole
+	var pending *float32
+	var pendingBits uint32
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		loop, offset, ok := h.loop(regAddr)
+		if !ok {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+
+		switch offset {
+		case pidModeReg:
+			if req.IsWrite {
+				if req.Args[i] > pidAuto {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				loop.mode = req.Args[i]
+			}
+			res = append(res, loop.mode)
+
+		case pidActionReg:
+			if req.IsWrite {
+				if req.Args[i] > pidDirectAction {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				loop.action = req.Args[i]
+			}
+			res = append(res, loop.action)
+
+		default:
+			// the other registers are float32, high word first, each word can be written on its own
+			value := loop.value(offset &^ 1)
+			if value == nil {
+				err = modbus.ErrIllegalDataAddress
+				log.Warnf("Illegal data address: %v", regAddr)
+				return
+			}
+
+			bits := math.Float32bits(*value)
+			if pending == value {
+				bits = pendingBits
+			}
+			if req.IsWrite {
+				if offset%2 == 0 {
+					bits = uint32(req.Args[i])<<16 | bits&0xffff
+				} else {
+					bits = bits&0xffff0000 | uint32(req.Args[i])
+				}
+
+				if offset%2 == 0 && i+1 < int(req.Quantity) {
+					pending, pendingBits = value, bits
+				} else {
+					// a NaN or an infinity would poison the integral for good,
+					// and the output min must stay below the output max
+					v := math.Float32frombits(bits)
+					if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) ||
+						(offset&^1 == pidOutputMinReg && v >= loop.outputMax) ||
+						(offset&^1 == pidOutputMaxReg && v <= loop.outputMin) {
+						err = modbus.ErrIllegalDataValue
+						log.Warnf("Illegal data value: %v", v)
+						return
+					}
+					*value = v
+					pending = nil
+				}
+			}
+
+			if offset%2 == 0 {
+				res = append(res, uint16((bits>>16)&0xffff))
+			} else {
+				res = append(res, uint16(bits&0xffff))
+			}
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *PIDHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		var value float32
+
+		loop, offset, ok := h.loop(regAddr)
+		switch {
+		case ok && offset&^1 == pidProcessVariableReg:
+			value = loop.processVariable
+		case ok && offset&^1 == pidOutputReg:
+			value = loop.output
+		case ok && offset&^1 == pidErrorReg:
+			value = loop.error
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+
+		if offset%2 == 0 {
+			res = append(res, uint16((math.Float32bits(value)>>16)&0xffff))
+		} else {
+			res = append(res, uint16((math.Float32bits(value))&0xffff))
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPIDControllerUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		loop pidController
+		dt   float32
+		pvs  []float32
+		want []float32
+	}{
+		{
+			name: "proportional",
+			loop: pidController{setpoint: 50, kp: 2, outputMax: 100, mode: pidAuto},
+			dt:   1, pvs: []float32{40, 80}, want: []float32{20, 0},
+		},
+		{
+			name: "direct action",
+			loop: pidController{setpoint: 50, kp: 2, outputMax: 100, mode: pidAuto, action: pidDirectAction},
+			dt:   1, pvs: []float32{60, 40}, want: []float32{20, 0},
+		},
+		{
+			name: "integral",
+			loop: pidController{setpoint: 10, ki: 0.5, outputMax: 100, mode: pidAuto},
+			dt:   1, pvs: []float32{0, 0, 0}, want: []float32{5, 10, 15},
+		},
+		{
+			name: "integral at 10 Hz",
+			loop: pidController{setpoint: 10, ki: 0.5, outputMax: 100, mode: pidAuto},
+			dt:   0.1, pvs: []float32{0, 0}, want: []float32{0.5, 1},
+		},
+		{
+			name: "integral stops at the limit",
+			loop: pidController{setpoint: 10, ki: 0.5, outputMax: 10, mode: pidAuto},
+			dt:   1, pvs: []float32{0, 0, 0, 12}, want: []float32{5, 10, 10, 9},
+		},
+		{
+			name: "integral reaches the limit in a single step",
+			loop: pidController{setpoint: 10, ki: 50, outputMax: 100, mode: pidAuto},
+			dt:   1, pvs: []float32{0, 0}, want: []float32{100, 100},
+		},
+		{
+			name: "derivative on the process variable",
+			loop: pidController{setpoint: 50, kd: 2, outputMin: -100, outputMax: 100, mode: pidAuto},
+			dt:   1, pvs: []float32{40, 45, 45}, want: []float32{0, -10, 0},
+		},
+		{
+			name: "manual",
+			loop: pidController{setpoint: 50, kp: 2, manualOutput: 30, outputMax: 100, mode: pidManual},
+			dt:   1, pvs: []float32{40, 0}, want: []float32{30, 30},
+		},
+		{
+			name: "manual output clamped",
+			loop: pidController{manualOutput: 150, outputMax: 100, mode: pidManual},
+			dt:   1, pvs: []float32{0}, want: []float32{100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.loop
+			for i, pv := range tt.pvs {
+				c.update(pv, tt.dt)
+				if math.Abs(float64(c.output-tt.want[i])) > 1e-4 {
+					t.Fatalf("step %v: output = %v, want %v", i, c.output, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPIDControllerBumplessTransfer(t *testing.T) {
+	c := pidController{setpoint: 50, kp: 1, ki: 0.1, manualOutput: 30, outputMax: 100, mode: pidManual}
+	c.update(40, 1)
+
+	// the integral tracked the manual output, so the output does not jump
+	c.mode = pidAuto
+	c.update(40, 1)
+	if want := float32(30 + 0.1*10); math.Abs(float64(c.output-want)) > 1e-4 {
+		t.Errorf("output after the transfer to auto = %v, want %v", c.output, want)
+	}
+	if c.manualOutput != c.output {
+		t.Errorf("manual output = %v, want it to track the output %v", c.manualOutput, c.output)
+	}
+}
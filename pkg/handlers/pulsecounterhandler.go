@@ -1,105 +1,358 @@
 package handler
 
+/*
+* This file contains the handler for the pulse counter simulation. Each
+* channel counts the pulses of a meter, e.g. a water meter giving one pulse
+* per litre or an energy meter giving one pulse per Wh. The pulses of a
+* channel follow its model: random bursts, a Poisson process, a fixed
+* frequency, a daily profile, or the flow of another device linked by the
+* topology. Without channels in the configuration, the counter has the three
+* random channels of the original simulation.
+ */
+
 import (
+	"fmt"
+	"math"
 	"math/rand"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/lopqto/icssimsuite/pkg/config"
 	"github.com/simonvetter/modbus"
 	log "github.com/sirupsen/logrus"
 )
 
+// The registers of channel i are at the base address plus i, plus 2 * i for
+// the 32 bit registers, or plus 4 * i for the 64 bit registers
 const (
 	// Coils
-	Pulse1StateReg = 0
-	Pulse2StateReg = 1
-	Pulse3StateReg = 2
+	pulseStateReg  = 0
+	pulseResetReg  = 100 // loads the preset into the count and clears the rollover
+	pulseFreezeReg = 200 // captures the counts of all the channels into their frozen counts
+
+	// Discrete Inputs (Read-Only)
+	pulseRolloverReg = 0 // latched until the reset
+
+	// Holding Registers (Read/Write)
+	pulsePresetReg = 100 // uint64
 
 	// Input Registers (Read-Only)
-	Pulse1Reg = 100
-	Pulse2Reg = 102
-	Pulse3Reg = 104
+	pulseCountReg           = 100 // uint32, the low 32 bits of the count
+	pulseValueReg           = 200 // float32, count * weight
+	pulseFrozenCountReg     = 300 // uint32, the low 32 bits of the count at the last freeze
+	pulseFullCountReg       = 400 // uint64
+	pulseFullFrozenCountReg = 600 // uint64, the count at the last freeze
+
+	// the number of channels fitting in the register map
+	pulseMaxChannels = 50
 )
 
-type PulseCounterHandler struct {
-	Lock sync.RWMutex
+// Pulse models
+const (
+	pulseModelRandom  = "random"  // bursts of min to max pulses, with a chance each second
+	pulseModelPoisson = "poisson" // a Poisson process of rate pulses per second
+	pulseModelFixed   = "fixed"   // rate pulses per second
+	pulseModelProfile = "profile" // the pulses per second of the hourly profile, interpolated over the day
+	pulseModelLinked  = "linked"  // the input linked by the topology, in units per second
+)
+
+type pulseChannel struct {
+	name   string
+	model  string
+	weight float32 // units per pulse, e.g. litres or kWh
+
+	// models
+	chance  float32
+	min     uint32
+	max     uint32
+	rate    float32   // pulses per second
+	profile []float32 // pulses per second for each hour of the day
+
+	// the channel counts its input instead when it is linked by the topology
+	linked bool
+	input  float32 // units per second
+
+	width    uint8 // bits of the count, it rolls over to 0 past its max
+	preset   uint64
+	count    uint64
+	frozen   uint64
+	rollover bool
+	fraction float32
+}
+
+func newPulseChannel(config config.PulseChannel, chance float32) *pulseChannel {
+	c := &pulseChannel{
+		name:    config.Name,
+		model:   config.Model,
+		weight:  config.Weight,
+		chance:  config.Chance,
+		min:     config.Min,
+		max:     config.Max,
+		rate:    config.Rate,
+		profile: config.Profile,
+		width:   config.Width,
+		preset:  config.Preset,
+	}
+	if c.width == 0 {
+		c.width = 32
+	}
+	if c.model == "" {
+		c.model = pulseModelRandom
+	}
+	if c.chance == 0 {
+		c.chance = chance
+	}
+	if c.weight == 0 {
+		c.weight = 1
+	}
+	return c
+}
 
-	coils [10]bool
+// validate checks the configuration of the channel
+func (c *pulseChannel) validate() error {
+	if c.name == "" || strings.Contains(c.name, ".") {
+		return fmt.Errorf("pulse channel name is empty or contains a dot: %q", c.name)
+	}
+	if c.weight < 0 {
+		return fmt.Errorf("pulse channel %v weight must be positive", c.name)
+	}
+	if c.width != 16 && c.width != 32 && c.width != 64 {
+		return fmt.Errorf("pulse channel %v width must be 16, 32 or 64 bits", c.name)
+	}
+	if c.preset > c.maxCount() {
+		return fmt.Errorf("pulse channel %v preset does not fit in %v bits", c.name, c.width)
+	}
 
-	pulse1 uint32
-	pulse2 uint32
-	pulse3 uint32
+	switch c.model {
+	case pulseModelRandom:
+		if c.max <= c.min {
+			return fmt.Errorf("pulse channel %v max must be above its min", c.name)
+		}
+	case pulseModelPoisson, pulseModelFixed:
+		if c.rate < 0 {
+			return fmt.Errorf("pulse channel %v rate must be positive", c.name)
+		}
+	case pulseModelProfile:
+		if len(c.profile) != 24 {
+			return fmt.Errorf("pulse channel %v profile must have 24 hourly values", c.name)
+		}
+	case pulseModelLinked:
+	default:
+		return fmt.Errorf("pulse channel %v has an unknown model %q, it must be random, poisson, fixed, profile or linked", c.name, c.model)
+	}
 
-	chanceToIncrement float32
+	return nil
 }
 
-func NewPulseCounterHandler(config config.PulseCounter) *PulseCounterHandler {
-	return &PulseCounterHandler{
-		chanceToIncrement: config.ChanceToIncrement,
+// profileRate returns the rate of the profile at the given time, interpolated between the hours
+func (c *pulseChannel) profileRate(t time.Time) float32 {
+	hours := float32(t.Hour()) + float32(t.Minute())/60 + float32(t.Second())/3600
+	hour := int(hours)
+	next := c.profile[(hour+1)%24]
+	return c.profile[hour] + (next-c.profile[hour])*(hours-float32(hour))
+}
+
+// poisson draws the number of events of a Poisson process with the given mean
+func poisson(mean float32) uint32 {
+	if mean <= 0 {
+		return 0
+	}
+	// the normal approximation holds for large means
+	if mean > 30 {
+		return uint32(max(0, math.Round(float64(mean)+math.Sqrt(float64(mean))*rand.NormFloat64())))
+	}
+	limit := math.Exp(-float64(mean))
+	events := uint32(0)
+	for p := rand.Float64(); p > limit; p *= rand.Float64() {
+		events++
 	}
+	return events
 }
 
-func (h *PulseCounterHandler) Init() error {
-	h.pulse1 = 0
-	h.pulse2 = 0
-	h.pulse3 = 0
+// maxCount returns the max count before the rollover
+func (c *pulseChannel) maxCount() uint64 {
+	return math.MaxUint64 >> (64 - c.width)
+}
 
-	h.coils[Pulse1StateReg] = true
-	h.coils[Pulse2StateReg] = true
-	h.coils[Pulse3StateReg] = true
+// add counts the given pulses, rolling over to 0 past the max count
+func (c *pulseChannel) add(pulses uint64) {
+	if pulses > c.maxCount()-c.count {
+		c.rollover = true
+	}
+	c.count = (c.count + pulses) & c.maxCount()
+}
 
-	return nil
+// reset loads the preset into the count and clears the rollover
+func (c *pulseChannel) reset() {
+	c.count = c.preset & c.maxCount()
+	c.rollover = false
+	c.fraction = 0
 }
 
-func (h *PulseCounterHandler) Update() error {
-	h.Lock.Lock()
-	defer h.Lock.Unlock()
+// step counts the pulses of the channel over the one second tick
+func (c *pulseChannel) step() {
+	var rate float32
+
+	switch {
+	case c.linked:
+		rate = max(0, c.input) / c.weight
+	case c.model == pulseModelRandom:
+		if rand.Float32() < c.chance {
+			c.add(uint64(rand.Intn(int(c.max-c.min))) + uint64(c.min))
+		}
+		return
+	case c.model == pulseModelPoisson:
+		c.add(uint64(poisson(c.rate)))
+		return
+	case c.model == pulseModelFixed:
+		rate = c.rate
+	case c.model == pulseModelProfile:
+		rate = max(0, c.profileRate(time.Now()))
+	}
+
+	// the fraction of a pulse is carried to the next tick
+	c.fraction += rate
+	whole := uint32(c.fraction)
+	c.fraction -= float32(whole)
+	c.add(uint64(whole))
+}
 
-	log.Debugf("Pulse 1 State: %v", h.coils[Pulse1StateReg])
-	log.Debugf("Pulse 2 State: %v", h.coils[Pulse2StateReg])
-	log.Debugf("Pulse 3 State: %v", h.coils[Pulse3StateReg])
+// value returns the engineering value of the count
+func (c *pulseChannel) value() float32 {
+	return float32(float64(c.count) * float64(c.weight))
+}
+
+type PulseCounterHandler struct {
+	Lock sync.RWMutex
 
-	// Pulse 1 goes up by a random number between 0 and 10
-	// Pulse 2 goes up by a random number between 40 and 70
-	// Pulse 3 goes up by a random number between 100 and 150
+	coils []bool
+
+	channels []*pulseChannel
+	names    map[string]*pulseChannel
+}
+
+func NewPulseCounterHandler(config config.PulseCounter) *PulseCounterHandler {
+	h := &PulseCounterHandler{names: make(map[string]*pulseChannel)}
 
-	// If the coils are set true and the random number is less than the chance to increment, increment the pulse
-	if h.coils[Pulse1StateReg] && rand.Float32() < h.chanceToIncrement {
-		h.pulse1 += uint32(rand.Intn(10))
+	for _, c := range config.Channels {
+		h.channels = append(h.channels, newPulseChannel(c, config.ChanceToIncrement))
 	}
-	if h.coils[Pulse2StateReg] && rand.Float32() < h.chanceToIncrement {
-		h.pulse2 += uint32(rand.Intn(30) + 40)
+	if len(h.channels) == 0 {
+		// the three random channels of the original simulation
+		for i, r := range [][2]uint32{{0, 10}, {40, 70}, {100, 150}} {
+			h.channels = append(h.channels, &pulseChannel{
+				name:   fmt.Sprintf("pulse%v", i+1),
+				model:  pulseModelRandom,
+				weight: 1,
+				chance: config.ChanceToIncrement,
+				min:    r[0],
+				max:    r[1],
+				width:  32,
+			})
+		}
 	}
-	if h.coils[Pulse3StateReg] && rand.Float32() < h.chanceToIncrement {
-		h.pulse3 += uint32(rand.Intn(50) + 100)
+	for _, c := range h.channels {
+		if _, ok := h.names[c.name]; !ok {
+			h.names[c.name] = c
+		}
 	}
 
-	log.Debugf("Pulse 1: %v", h.pulse1)
-	log.Debugf("Pulse 2: %v", h.pulse2)
-	log.Debugf("Pulse 3: %v", h.pulse3)
+	// one state coil per channel, and at least the ten state coils of the original simulation
+	h.coils = make([]bool, max(10, len(h.channels)))
+
+	return h
+}
+
+func (h *PulseCounterHandler) Init() error {
+	if len(h.channels) > pulseMaxChannels {
+		return fmt.Errorf("pulse counter supports up to %v channels", pulseMaxChannels)
+	}
+	if len(h.names) != len(h.channels) {
+		return fmt.Errorf("pulse channel names must be unique")
+	}
 
-	//TODO: Should we reset the pulses when user presses the reset button?
+	for i, c := range h.channels {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		// the links are connected before the devices are initialized
+		if c.model == pulseModelLinked && !c.linked {
+			log.Warnf("Pulse channel %v has the linked model but no topology link, it will not count", c.name)
+		}
+		c.reset()
+		h.coils[pulseStateReg+i] = true
+	}
 
 	return nil
 }
 
-func (h *PulseCounterHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
-	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
-		err = modbus.ErrIllegalDataAddress
-		log.Warnf("Illegal data address: %v", req.Addr)
-		return
+// SetInput sets the rate counted by the named channel, in units per second,
+// e.g. a flow in L/s counted by a channel weighing one litre per pulse
+func (h *PulseCounterHandler) SetInput(port string, value float32) bool {
+	c, ok := h.names[port]
+	if !ok {
+		return false
+	}
+
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+	c.linked = true
+	c.input = value
+	return true
+}
+
+func (h *PulseCounterHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	// the channels only count while their state coil is set
+	for i, c := range h.channels {
+		if h.coils[pulseStateReg+i] {
+			c.step()
+		}
+		log.Debugf("Pulse %v: State: %v, Count: %v, Value: %v, Rollover: %v", c.name, h.coils[pulseStateReg+i], c.count, c.value(), c.rollover)
 	}
 
+	return nil
+}
+
+func (h *PulseCounterHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
 	h.Lock.Lock()
 	// release the lock upon return
 	defer h.Lock.Unlock()
 
 	for i := 0; i < int(req.Quantity); i++ {
-		if i < len(req.Args) {
-			// only update the coils if the value is provided
-			h.coils[int(req.Addr)+i] = req.Args[i]
+		regAddr := req.Addr + uint16(i)
+
+		switch {
+		case int(regAddr) < len(h.coils):
+			if i < len(req.Args) {
+				// only update the coils if the value is provided
+				h.coils[regAddr] = req.Args[i]
+			}
+			res = append(res, h.coils[regAddr])
+
+		// the reset and freeze coils act as push buttons and always read false
+		case regAddr >= pulseResetReg && int(regAddr-pulseResetReg) < len(h.channels):
+			if i < len(req.Args) && req.Args[i] {
+				h.channels[regAddr-pulseResetReg].reset()
+			}
+			res = append(res, false)
+
+		case regAddr == pulseFreezeReg:
+			if i < len(req.Args) && req.Args[i] {
+				for _, c := range h.channels {
+					c.frozen = c.count
+				}
+			}
+			res = append(res, false)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
 		}
-		res = append(res, h.coils[int(req.Addr)+i])
 	}
 
 	log.Tracef("Coils: %v", res)
@@ -108,42 +361,95 @@ func (h *PulseCounterHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool,
 }
 
 func (h *PulseCounterHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
-	err = modbus.ErrIllegalFunction
-	log.Warn("Illegal function: DiscreteInputs")
-	return res, err
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		if int(regAddr-pulseRolloverReg) >= len(h.channels) {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+		res = append(res, h.channels[regAddr-pulseRolloverReg].rollover)
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
 }
 
 func (h *PulseCounterHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
-	err = modbus.ErrIllegalFunction
-	log.Warn("Illegal function: HoldingRegisters")
-	return res, err
-}
+	var regAddr uint16
 
-func (h *PulseCounterHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
 
-	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
-		switch regAddr {
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		c, ok := h.channel(regAddr, pulsePresetReg, 4)
+		if !ok {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
 
-		case Pulse1Reg:
-			res = append(res, uint16((h.pulse1>>16)&0xffff))
-		case Pulse1Reg + 1:
-			res = append(res, uint16(h.pulse1&0xffff))
+		// the preset is a uint64, highest word first, each word can be written on its own
+		shift := 16 * (3 - (regAddr-pulsePresetReg)%4)
+		if req.IsWrite {
+			preset := c.preset&^(0xffff<<shift) | uint64(req.Args[i])<<shift
+			if preset > c.maxCount() {
+				err = modbus.ErrIllegalDataValue
+				log.Warnf("Illegal data value: %v", req.Args[i])
+				return
+			}
+			c.preset = preset
+		}
+		res = append(res, uint16((c.preset>>shift)&0xffff))
+	}
 
-		case Pulse2Reg:
-			res = append(res, uint16((h.pulse2>>16)&0xffff))
-		case Pulse2Reg + 1:
-			res = append(res, uint16(h.pulse2&0xffff))
+	log.Tracef("Holding Registers: %v", res)
 
-		case Pulse3Reg:
-			res = append(res, uint16((h.pulse3>>16)&0xffff))
-		case Pulse3Reg + 1:
-			res = append(res, uint16(h.pulse3&0xffff))
+	return res, nil
+}
 
-		default:
+// channel returns the channel of the register at the given address, from the
+// base address of the registers of the given size
+func (h *PulseCounterHandler) channel(addr uint16, base uint16, size int) (*pulseChannel, bool) {
+	if addr < base || int(addr-base) >= size*len(h.channels) {
+		return nil, false
+	}
+	return h.channels[int(addr-base)/size], true
+}
+
+func (h *PulseCounterHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		var bits uint64
+		var shift uint16
+
+		// the 32 bit registers have their high word at the even address
+		if c, ok := h.channel(regAddr, pulseCountReg, 2); ok {
+			bits, shift = c.count, 16*(1-regAddr%2)
+		} else if c, ok := h.channel(regAddr, pulseValueReg, 2); ok {
+			bits, shift = uint64(math.Float32bits(c.value())), 16*(1-regAddr%2)
+		} else if c, ok := h.channel(regAddr, pulseFrozenCountReg, 2); ok {
+			bits, shift = c.frozen, 16*(1-regAddr%2)
+		} else if c, ok := h.channel(regAddr, pulseFullCountReg, 4); ok {
+			// the 64 bit counts have their highest word first
+			bits, shift = c.count, 16*(3-(regAddr-pulseFullCountReg)%4)
+		} else if c, ok := h.channel(regAddr, pulseFullFrozenCountReg, 4); ok {
+			bits, shift = c.frozen, 16*(3-(regAddr-pulseFullFrozenCountReg)%4)
+		} else {
 			log.Warnf("Illegal data address: %v", regAddr)
 			err = modbus.ErrIllegalDataAddress
 			return
 		}
+
+		res = append(res, uint16((bits>>shift)&0xffff))
 	}
 
 	log.Tracef("Input Registers: %v", res)
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPulseChannelAdd(t *testing.T) {
+	tests := []struct {
+		name         string
+		width        uint8
+		count        uint64
+		pulses       uint64
+		want         uint64
+		wantRollover bool
+	}{
+		{"16 bits", 16, 0, 5, 5, false},
+		{"16 bits up to the max", 16, 65530, 5, 65535, false},
+		{"16 bits past the max", 16, 65535, 1, 0, true},
+		{"16 bits across the max", 16, 65530, 10, 4, true},
+		{"16 bits full turn", 16, 0, 65536, 0, true},
+		{"no pulses at the max", 16, 65535, 0, 65535, false},
+		{"32 bits across the max", 32, math.MaxUint32, 2, 1, true},
+		{"32 bits past 16 bits", 32, 65535, 1, 65536, false},
+		{"64 bits up to the max", 64, math.MaxUint64 - 1, 1, math.MaxUint64, false},
+		{"64 bits past the max", 64, math.MaxUint64, 1, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &pulseChannel{width: tt.width, count: tt.count}
+			c.add(tt.pulses)
+			if c.count != tt.want || c.rollover != tt.wantRollover {
+				t.Errorf("add(%v) to %v = %v, rollover %v, want %v, rollover %v",
+					tt.pulses, tt.count, c.count, c.rollover, tt.want, tt.wantRollover)
+			}
+		})
+	}
+}
+
+func TestPulseChannelRolloverLatches(t *testing.T) {
+	c := &pulseChannel{width: 16, count: 65535, preset: 100}
+	c.add(1)
+	c.add(1)
+	if !c.rollover {
+		t.Fatal("rollover cleared by the next pulse")
+	}
+
+	c.reset()
+	if c.rollover || c.count != 100 {
+		t.Errorf("reset = %v, rollover %v, want 100, rollover false", c.count, c.rollover)
+	}
+}
@@ -0,0 +1,509 @@
+package handler
+
+/*
+* This file contains the handler for the solar PV inverter simulation.
+* The DC power of the array follows an irradiance model based on the
+* position of the sun (time of day, latitude and longitude) and the
+* cloud cover reported by the weather source.
+ */
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/lopqto/icssimsuite/pkg/sunspec"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	solarEnableReg = 0
+
+	// Holding Registers (Read/Write)
+	solarCurtailmentReg = 100
+
+	// Input Registers (Read-Only)
+	solarACPowerReg     = 100
+	solarACVoltageReg   = 102
+	solarACCurrentReg   = 104
+	solarACFrequencyReg = 106
+	solarDCPowerReg     = 108
+	solarDCVoltageReg   = 110
+	solarDCCurrentReg   = 112
+	solarIrradianceReg  = 114
+	solarCellTempReg    = 116
+	solarDailyEnergyReg = 118
+	solarTotalEnergyReg = 120
+	solarStateReg       = 200
+)
+
+// Inverter operating states, numbered as in the SunSpec inverter models
+const (
+	inverterStateOff          = 1
+	inverterStateSleeping     = 2
+	inverterStateStarting     = 3
+	inverterStateMPPT         = 4
+	inverterStateThrottled    = 5
+	inverterStateShuttingDown = 6
+	inverterStateFault        = 7
+	inverterStateStandby      = 8
+)
+
+const (
+	// irradiance at standard test conditions
+	stcIrradiance = 1000 // W/m2
+	// nominal operating cell temperature
+	noct = 45 // Celsius
+	// minimum DC power, as a fraction of the rated power, to wake up the inverter
+	inverterWakeUpRatio = 0.01
+	// grid checks before the inverter connects
+	inverterStartDelay = 30 // seconds
+)
+
+type SolarHandler struct {
+	Lock sync.RWMutex
+
+	coils [10]bool
+
+	latitude               float64
+	longitude              float64
+	ratedPower             float32 // kWp
+	maxACPower             float32 // kW
+	inverterEfficiency     float32
+	mppVoltage             float32
+	temperatureCoefficient float32 // %/Celsius
+	nominalACVoltage       float32
+	nominalACFrequency     float32
+	phases                 int
+
+	// the SunSpec map is rebuilt on every update when enabled
+	sunSpec      bool
+	sunSpecMap   sunspec.Map
+	serialNumber string
+
+	curtailment uint16 // %
+
+	ambientTemperature float32
+	cloudCover         float32 // %
+
+	irradiance      float32 // W/m2
+	cellTemperature float32
+	dcPower         float32 // W
+	dcVoltage       float32
+	dcCurrent       float32
+	acPower         float32 // W
+	acVoltage       float32
+	acCurrent       float32
+	acFrequency     float32
+
+	state        uint16
+	startCounter uint16
+
+	// energy counters are kept in float64 so small increments
+	// are not lost once the totals grow large
+	dailyEnergy float64 // kWh
+	totalEnergy float64 // kWh
+	day         int
+}
+
+func NewSolarHandler(config config.Solar) *SolarHandler {
+	return &SolarHandler{
+		latitude:               config.Latitude,
+		longitude:              config.Longitude,
+		ratedPower:             config.RatedPower,
+		maxACPower:             config.MaxACPower,
+		inverterEfficiency:     config.InverterEfficiency,
+		mppVoltage:             config.MPPVoltage,
+		temperatureCoefficient: config.TemperatureCoefficient,
+		nominalACVoltage:       config.ACVoltage,
+		nominalACFrequency:     config.ACFrequency,
+		phases:                 config.Phases,
+		sunSpec:                config.SunSpec,
+		serialNumber:           config.SerialNumber,
+	}
+}
+
+func (h *SolarHandler) SetTemperature(temperature float32) {
+	h.Lock.Lock()
+	h.ambientTemperature = temperature
+	h.Lock.Unlock()
+}
+
+func (h *SolarHandler) SetCloudCover(cloudCover float32) {
+	h.Lock.Lock()
+	h.cloudCover = cloudCover
+	h.Lock.Unlock()
+}
+
+// Power returns the power drawn by the inverter in W, negative when feeding in
+func (h *SolarHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return -h.acPower
+}
+
+// Output returns the value of the named topology output
+func (h *SolarHandler) Output(port string) (float32, bool) {
+	switch port {
+	case "power":
+		return h.Power(), true
+	}
+	return 0, false
+}
+
+func (h *SolarHandler) Init() error {
+	// the AC current is the power over the voltage, and the power is limited
+	// to the rating of the inverter
+	if h.ratedPower <= 0 || h.maxACPower <= 0 {
+		return fmt.Errorf("solar rated power and max AC power must be positive")
+	}
+	if h.nominalACVoltage <= 0 {
+		return fmt.Errorf("solar AC voltage must be positive")
+	}
+	if h.inverterEfficiency <= 0 || h.inverterEfficiency > 1 {
+		h.inverterEfficiency = 1
+	}
+	if h.phases != 3 {
+		h.phases = 1
+	}
+
+	h.ambientTemperature = 25
+	h.cloudCover = 0
+	h.curtailment = 100
+	h.state = inverterStateSleeping
+	h.acVoltage = h.nominalACVoltage
+	h.acFrequency = h.nominalACFrequency
+	h.day = time.Now().YearDay()
+
+	h.coils[solarEnableReg] = true
+
+	if h.sunSpec {
+		h.updateSunSpec()
+	}
+
+	return nil
+}
+
+// clearSkyIrradiance returns the global horizontal irradiance under a clear sky
+// for the given time and location, using the Haurwitz model.
+func clearSkyIrradiance(t time.Time, latitude, longitude float64) float64 {
+	t = t.UTC()
+	dayOfYear := float64(t.YearDay())
+	rad := math.Pi / 180
+
+	// solar declination
+	declination := 23.45 * math.Sin(rad*360/365*(284+dayOfYear))
+
+	// equation of time, in minutes
+	b := rad * 360 / 365 * (dayOfYear - 81)
+	equationOfTime := 9.87*math.Sin(2*b) - 7.53*math.Cos(b) - 1.5*math.Sin(b)
+
+	// apparent solar time and hour angle
+	hours := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	solarTime := hours + longitude/15 + equationOfTime/60
+	hourAngle := 15 * (solarTime - 12)
+
+	sinElevation := math.Sin(rad*latitude)*math.Sin(rad*declination) +
+		math.Cos(rad*latitude)*math.Cos(rad*declination)*math.Cos(rad*hourAngle)
+	if sinElevation <= 0 {
+		return 0
+	}
+
+	return 1098 * sinElevation * math.Exp(-0.057/sinElevation)
+}
+
+func (h *SolarHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	now := time.Now()
+
+	// reset the daily energy counter at midnight
+	if now.YearDay() != h.day {
+		h.day = now.YearDay()
+		h.dailyEnergy = 0
+	}
+
+	// cloud attenuation follows Kasten and Czeplak, with some flicker
+	// from passing clouds
+	clouds := float64(h.cloudCover) / 100
+	irradiance := clearSkyIrradiance(now, h.latitude, h.longitude)
+	irradiance *= 1 - 0.75*math.Pow(clouds, 3.4)
+	irradiance *= 1 - 0.1*clouds*rand.Float64()
+	h.irradiance = float32(irradiance)
+	log.Debugf("Irradiance: %v", h.irradiance)
+
+	h.cellTemperature = h.ambientTemperature + (noct-20)/800.0*h.irradiance
+	temperatureFactor := 1 + h.temperatureCoefficient/100*(h.cellTemperature-25)
+
+	// available DC power at the maximum power point
+	h.dcPower = h.ratedPower * 1000 * h.irradiance / stcIrradiance * temperatureFactor
+	h.dcPower = max(0, h.dcPower)
+
+	if h.irradiance > 0 {
+		// the voltage drops logarithmically with the irradiance and linearly with the temperature
+		h.dcVoltage = h.mppVoltage * (1 + 0.05*float32(math.Log(float64(h.irradiance/stcIrradiance))))
+		h.dcVoltage *= 1 - 0.003*(h.cellTemperature-25)
+		h.dcVoltage = max(0, h.dcVoltage)
+	} else {
+		h.dcVoltage = 0
+	}
+
+	// update the inverter state
+	awake := h.dcPower > h.ratedPower*1000*inverterWakeUpRatio
+	switch {
+	case !h.coils[solarEnableReg]:
+		h.state = inverterStateOff
+	case !awake:
+		h.state = inverterStateSleeping
+	case h.state == inverterStateOff || h.state == inverterStateSleeping:
+		h.state = inverterStateStarting
+		h.startCounter = 0
+	case h.state == inverterStateStarting:
+		h.startCounter++
+		if h.startCounter >= inverterStartDelay {
+			h.state = inverterStateMPPT
+		}
+	}
+	log.Debugf("Inverter State: %v", h.state)
+
+	h.acPower = 0
+	if h.state == inverterStateMPPT || h.state == inverterStateThrottled {
+		limit := min(h.maxACPower*1000, h.maxACPower*1000*float32(h.curtailment)/100)
+		h.acPower = h.dcPower * h.inverterEfficiency
+		h.state = inverterStateMPPT
+		if h.acPower > limit {
+			// move away from the maximum power point to hold the limit
+			h.acPower = limit
+			h.dcPower = limit / h.inverterEfficiency
+			h.state = inverterStateThrottled
+		}
+	} else {
+		// the array is left open circuit
+		h.dcPower = 0
+	}
+
+	if h.dcVoltage > 0 {
+		h.dcCurrent = h.dcPower / h.dcVoltage
+	} else {
+		h.dcCurrent = 0
+	}
+
+	// grid voltage and frequency fluctuate slightly
+	h.acVoltage = h.nominalACVoltage * (0.98 + 0.04*rand.Float32())
+	h.acFrequency = h.nominalACFrequency + 0.1*(rand.Float32()-0.5)
+	// the current is reported per phase
+	h.acCurrent = h.acPower / h.acVoltage / float32(h.phases)
+	log.Debugf("DC Power: %v, AC Power: %v", h.dcPower, h.acPower)
+
+	// energy is integrated over the one second tick
+	energy := float64(h.acPower) / 1000 / 3600
+	h.dailyEnergy += energy
+	h.totalEnergy += energy
+
+	if h.sunSpec {
+		h.updateSunSpec()
+	}
+
+	return nil
+}
+
+// updateSunSpec rebuilds the SunSpec map with the common and inverter models
+func (h *SolarHandler) updateSunSpec() {
+	acCurrent := float64(h.acCurrent)
+	acVoltage := float64(h.acVoltage)
+
+	inverter := sunspec.Inverter{
+		Phases:        h.phases,
+		Current:       acCurrent * float64(h.phases),
+		Power:         float64(h.acPower),
+		Frequency:     float64(h.acFrequency),
+		ApparentPower: float64(h.acPower),
+		PowerFactor:   100,
+		Energy:        h.totalEnergy * 1000,
+		DCCurrent:     float64(h.dcCurrent),
+		DCVoltage:     float64(h.dcVoltage),
+		DCPower:       float64(h.dcPower),
+		// the cabinet warms up with the conversion losses
+		CabinetTemperature: float64(h.ambientTemperature + 15*h.acPower/(h.maxACPower*1000)),
+		State:              h.state,
+	}
+	for i := 0; i < h.phases; i++ {
+		inverter.PhaseCurrent[i] = acCurrent
+		inverter.PhaseVoltage[i] = acVoltage
+		inverter.LineVoltage[i] = acVoltage * math.Sqrt(3)
+	}
+
+	h.sunSpecMap = sunspec.NewMap(
+		sunspec.CommonModel(sunspec.Common{
+			Manufacturer:  "ICSSimSuite",
+			Model:         "PV Inverter",
+			Version:       "1.0",
+			SerialNumber:  h.serialNumber,
+			DeviceAddress: SolarUnitId,
+		}),
+		sunspec.InverterModel(inverter),
+	)
+}
+
+func (h *SolarHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *SolarHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	err = modbus.ErrIllegalFunction
+	log.Warn("Illegal function: DiscreteInputs")
+	return res, err
+}
+
+func (h *SolarHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	// the SunSpec map is read-only
+	if h.sunSpec && h.sunSpecMap.Contains(req.Addr) {
+		var ok bool
+		res, ok = h.sunSpecMap.Read(req.Addr, req.Quantity)
+		if !ok || req.IsWrite {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", req.Addr)
+			return nil, err
+		}
+		log.Tracef("SunSpec Registers: %v", res)
+		return res, nil
+	}
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		switch regAddr {
+		case solarCurtailmentReg:
+			if req.IsWrite {
+				if req.Args[i] > 100 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.curtailment = req.Args[i]
+			}
+			res = append(res, h.curtailment)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *SolarHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	dailyEnergy := float32(h.dailyEnergy)
+	totalEnergy := float32(h.totalEnergy)
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case solarACPowerReg:
+			res = append(res, uint16((math.Float32bits(h.acPower)>>16)&0xffff))
+		case solarACPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.acPower))&0xffff))
+
+		case solarACVoltageReg:
+			res = append(res, uint16((math.Float32bits(h.acVoltage)>>16)&0xffff))
+		case solarACVoltageReg + 1:
+			res = append(res, uint16((math.Float32bits(h.acVoltage))&0xffff))
+
+		case solarACCurrentReg:
+			res = append(res, uint16((math.Float32bits(h.acCurrent)>>16)&0xffff))
+		case solarACCurrentReg + 1:
+			res = append(res, uint16((math.Float32bits(h.acCurrent))&0xffff))
+
+		case solarACFrequencyReg:
+			res = append(res, uint16((math.Float32bits(h.acFrequency)>>16)&0xffff))
+		case solarACFrequencyReg + 1:
+			res = append(res, uint16((math.Float32bits(h.acFrequency))&0xffff))
+
+		case solarDCPowerReg:
+			res = append(res, uint16((math.Float32bits(h.dcPower)>>16)&0xffff))
+		case solarDCPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.dcPower))&0xffff))
+
+		case solarDCVoltageReg:
+			res = append(res, uint16((math.Float32bits(h.dcVoltage)>>16)&0xffff))
+		case solarDCVoltageReg + 1:
+			res = append(res, uint16((math.Float32bits(h.dcVoltage))&0xffff))
+
+		case solarDCCurrentReg:
+			res = append(res, uint16((math.Float32bits(h.dcCurrent)>>16)&0xffff))
+		case solarDCCurrentReg + 1:
+			res = append(res, uint16((math.Float32bits(h.dcCurrent))&0xffff))
+
+		case solarIrradianceReg:
+			res = append(res, uint16((math.Float32bits(h.irradiance)>>16)&0xffff))
+		case solarIrradianceReg + 1:
+			res = append(res, uint16((math.Float32bits(h.irradiance))&0xffff))
+
+		case solarCellTempReg:
+			res = append(res, uint16((math.Float32bits(h.cellTemperature)>>16)&0xffff))
+		case solarCellTempReg + 1:
+			res = append(res, uint16((math.Float32bits(h.cellTemperature))&0xffff))
+
+		case solarDailyEnergyReg:
+			res = append(res, uint16((math.Float32bits(dailyEnergy)>>16)&0xffff))
+		case solarDailyEnergyReg + 1:
+			res = append(res, uint16((math.Float32bits(dailyEnergy))&0xffff))
+
+		case solarTotalEnergyReg:
+			res = append(res, uint16((math.Float32bits(totalEnergy)>>16)&0xffff))
+		case solarTotalEnergyReg + 1:
+			res = append(res, uint16((math.Float32bits(totalEnergy))&0xffff))
+
+		case solarStateReg:
+			res = append(res, h.state)
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
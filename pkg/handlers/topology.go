@@ -0,0 +1,203 @@
+package handler
+
+/*
+* This file contains the process topology. Devices expose named outputs
+* (e.g. the outflow of a water tank or the power of the HVAC) and named
+* inputs (e.g. the inflow of a water tank or the load of an energy meter),
+* and the topology links outputs to inputs. Every tick the devices are
+* updated in dependency order, and each input is set to the sum of the
+* outputs linked to it before its device is updated.
+ */
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Device is implemented by every simulated device
+type Device interface {
+	modbus.RequestHandler
+
+	// Init prepares the device, it runs once before the first update
+	Init() error
+	// Update advances the simulation by one tick of one second
+	Update() error
+}
+
+// outputDevice is implemented by the devices exposing values to the topology
+type outputDevice interface {
+	// Output returns the current value of the named output, it reports whether the output exists
+	Output(port string) (float32, bool)
+}
+
+// inputDevice is implemented by the devices taking values from the topology
+type inputDevice interface {
+	// SetInput sets the value of the named input, it reports whether the input exists.
+	// It is called once with 0 when a link is connected to the input.
+	SetInput(port string, value float32) bool
+}
+
+// suppliedDevice is implemented by the devices powered through their "supply"
+// input, e.g. from a breaker, they are de-energised while it is below 0.5
+type suppliedDevice interface {
+	inputDevice
+	// Energised reports whether the supply of the device is energised
+	Energised() bool
+}
+
+// device is an enabled device registered with the handler
+type device struct {
+	name    string
+	unitId  uint8
+	handler Device
+
+	// links into the inputs of the device
+	inputs []link
+}
+
+// link connects an output of a device to an input of another device
+type link struct {
+	from     *device
+	fromPort string
+	toPort   string
+}
+
+// splitPort splits a "device.port" link endpoint
+func splitPort(endpoint string) (name string, port string, err error) {
+	name, port, ok := strings.Cut(endpoint, ".")
+	if !ok || name == "" || port == "" {
+		return "", "", fmt.Errorf("topology link endpoint is not device.port: %v", endpoint)
+	}
+	return name, port, nil
+}
+
+// connect validates a link and attaches it to the device it feeds
+func (h *Handler) connect(from string, to string) error {
+	fromName, fromPort, err := splitPort(from)
+	if err != nil {
+		return err
+	}
+	toName, toPort, err := splitPort(to)
+	if err != nil {
+		return err
+	}
+
+	source, ok := h.names[fromName]
+	if !ok {
+		return fmt.Errorf("topology link from an unknown or disabled device: %v", from)
+	}
+	target, ok := h.names[toName]
+	if !ok {
+		return fmt.Errorf("topology link to an unknown or disabled device: %v", to)
+	}
+	if source == target {
+		return fmt.Errorf("topology link from a device to itself: %v -> %v", from, to)
+	}
+
+	output, ok := source.handler.(outputDevice)
+	if !ok {
+		return fmt.Errorf("topology link from a device without outputs: %v", from)
+	}
+	if _, ok := output.Output(fromPort); !ok {
+		return fmt.Errorf("topology link from an unknown output: %v", from)
+	}
+	input, ok := target.handler.(inputDevice)
+	if !ok || !input.SetInput(toPort, 0) {
+		return fmt.Errorf("topology link to an unknown input: %v", to)
+	}
+
+	log.Debugf("Topology: %v -> %v", from, to)
+	target.inputs = append(target.inputs, link{from: source, fromPort: fromPort, toPort: toPort})
+
+	return nil
+}
+
+// updateOrder returns the devices so that each device comes after the devices
+// linked to its inputs, keeping the registration order otherwise. The devices
+// in a cycle are updated in registration order, reading the outputs of the
+// previous tick where the cycle closes.
+func (h *Handler) updateOrder() []*device {
+	order := make([]*device, 0, len(h.devices))
+	done := make(map[*device]bool)
+
+	for len(order) < len(h.devices) {
+		progress := false
+		for _, d := range h.devices {
+			if done[d] {
+				continue
+			}
+
+			ready := true
+			for _, l := range d.inputs {
+				if !done[l.from] {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				order = append(order, d)
+				done[d] = true
+				progress = true
+			}
+		}
+
+		// break the cycle at the first device left in a cycle, the devices
+		// only waiting on the cycle are updated after it
+		if !progress {
+			for _, d := range h.devices {
+				if !done[d] && inCycle(d, done) {
+					log.Infof("Topology: %v is part of a cycle, it reads the outputs of the previous tick", d.name)
+					order = append(order, d)
+					done[d] = true
+					break
+				}
+			}
+		}
+	}
+
+	return order
+}
+
+// inCycle reports whether the device is linked back to itself through the
+// devices not updated yet
+func inCycle(d *device, done map[*device]bool) bool {
+	seen := make(map[*device]bool)
+	pending := []*device{d}
+	for len(pending) > 0 {
+		next := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, l := range next.inputs {
+			if done[l.from] || seen[l.from] {
+				continue
+			}
+			if l.from == d {
+				return true
+			}
+			seen[l.from] = true
+			pending = append(pending, l.from)
+		}
+	}
+	return false
+}
+
+// resolveInputs sets each input of the device to the sum of the outputs linked to it
+func (d *device) resolveInputs() {
+	if len(d.inputs) == 0 {
+		return
+	}
+
+	values := make(map[string]float32)
+	for _, l := range d.inputs {
+		value, _ := l.from.handler.(outputDevice).Output(l.fromPort)
+		values[l.toPort] += value
+	}
+
+	input := d.handler.(inputDevice)
+	for port, value := range values {
+		input.SetInput(port, value)
+	}
+}
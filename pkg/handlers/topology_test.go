@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdateOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []string
+		links   []string // "from>to"
+		want    []string
+	}{
+		{"no links", []string{"a", "b", "c"}, nil, []string{"a", "b", "c"}},
+		{"chain", []string{"a", "b", "c"}, []string{"c>b", "b>a"}, []string{"c", "b", "a"}},
+		{"fan in", []string{"a", "c", "b"}, []string{"a>c", "b>c"}, []string{"a", "b", "c"}},
+		{"self loop", []string{"a", "b"}, []string{"a>a", "a>b"}, []string{"a", "b"}},
+		{"cycle", []string{"a", "b"}, []string{"a>b", "b>a"}, []string{"a", "b"}},
+		{"cycle after its feeder", []string{"b", "c", "a"}, []string{"a>b", "b>c", "c>b"}, []string{"a", "b", "c"}},
+		{"device waiting on a cycle", []string{"x", "a", "b"}, []string{"b>x", "a>b", "b>a"}, []string{"a", "b", "x"}},
+		{"two cycles", []string{"a", "b", "c", "d"}, []string{"a>b", "b>a", "b>c", "c>d", "d>c"}, []string{"a", "b", "c", "d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{names: make(map[string]*device)}
+			for _, name := range tt.devices {
+				d := &device{name: name}
+				h.devices = append(h.devices, d)
+				h.names[name] = d
+			}
+			for _, l := range tt.links {
+				from, to, _ := strings.Cut(l, ">")
+				h.names[to].inputs = append(h.names[to].inputs, link{from: h.names[from]})
+			}
+
+			var got []string
+			for _, d := range h.updateOrder() {
+				got = append(got, d.name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("updateOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
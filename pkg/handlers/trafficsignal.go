@@ -0,0 +1,358 @@
+package handler
+
+/*
+* This file contains the handler for the traffic signal controller simulation.
+* The controller runs a fixed time plan on a two approach intersection (main
+* and side street), can be put in flash mode, or driven lamp by lamp in manual
+* override. An independent conflict monitor watches the lamps and forces an
+* all-red flash that latches until it is reset when conflicting greens show.
+ */
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	signalFlashReg         = 0
+	signalManualReg        = 1 // the lamps follow the manual lamp coils
+	signalConflictResetReg = 2
+	// manual lamp coils, in the same order as the lamp discrete inputs
+	signalManualLampsReg = 3
+
+	// Discrete Inputs (Read-Only)
+	signalMainRedReg    = 0
+	signalMainYellowReg = 1
+	signalMainGreenReg  = 2
+	signalSideRedReg    = 3
+	signalSideYellowReg = 4
+	signalSideGreenReg  = 5
+	signalFlashingReg   = 6
+	signalConflictReg   = 7
+
+	// Holding Registers (Read/Write)
+	signalMainGreenTimeReg  = 100 // seconds
+	signalMainYellowTimeReg = 101
+	signalAllRedTimeReg     = 102
+	signalSideGreenTimeReg  = 103
+	signalSideYellowTimeReg = 104
+
+	// Input Registers (Read-Only)
+	signalPhaseReg         = 100
+	signalRemainingReg     = 101 // seconds
+	signalCycleCountReg    = 102
+	signalConflictCountReg = 103
+)
+
+// Signal phases
+const (
+	signalPhaseMainGreen  = 0
+	signalPhaseMainYellow = 1
+	signalPhaseMainClear  = 2 // all red after the main street
+	signalPhaseSideGreen  = 3
+	signalPhaseSideYellow = 4
+	signalPhaseSideClear  = 5 // all red after the side street
+	signalPhases          = 6
+)
+
+// signalLamps is the number of lamps, three per approach
+const signalLamps = 6
+
+type TrafficSignalHandler struct {
+	Lock sync.RWMutex
+
+	coils          [10]bool
+	discreteInputs [10]bool
+
+	mainGreenTime  uint16
+	mainYellowTime uint16
+	allRedTime     uint16
+	sideGreenTime  uint16
+	sideYellowTime uint16
+
+	phase         uint16
+	phaseTimer    uint16
+	flashOn       bool
+	cycleCount    uint16
+	conflictCount uint16
+}
+
+func NewTrafficSignalHandler(config config.TrafficSignal) *TrafficSignalHandler {
+	return &TrafficSignalHandler{
+		mainGreenTime:  config.MainGreen,
+		mainYellowTime: config.MainYellow,
+		allRedTime:     config.AllRed,
+		sideGreenTime:  config.SideGreen,
+		sideYellowTime: config.SideYellow,
+	}
+}
+
+// timing returns the phase time held by the given register with its limits
+// and its default in seconds, the controller refuses timings outside of the
+// usual engineering limits
+func (h *TrafficSignalHandler) timing(reg uint16) (value *uint16, minTime uint16, maxTime uint16, defaultTime uint16, ok bool) {
+	switch reg {
+	case signalMainGreenTimeReg:
+		return &h.mainGreenTime, 5, 300, 30, true
+	case signalMainYellowTimeReg:
+		return &h.mainYellowTime, 3, 10, 4, true
+	case signalAllRedTimeReg:
+		return &h.allRedTime, 1, 10, 2, true
+	case signalSideGreenTimeReg:
+		return &h.sideGreenTime, 5, 300, 20, true
+	case signalSideYellowTimeReg:
+		return &h.sideYellowTime, 3, 10, 4, true
+	}
+	return nil, 0, 0, 0, false
+}
+
+func (h *TrafficSignalHandler) Init() error {
+	// an unset phase time takes its default, a phase time of zero would skip the phase
+	for reg := uint16(signalMainGreenTimeReg); reg <= signalSideYellowTimeReg; reg++ {
+		value, minTime, maxTime, defaultTime, _ := h.timing(reg)
+		if *value == 0 {
+			*value = defaultTime
+		}
+		if *value < minTime || *value > maxTime {
+			return fmt.Errorf("traffic signal phase time of register %v must be between %v and %v s, not %v s", reg, minTime, maxTime, *value)
+		}
+	}
+
+	// the controller starts with an all red clearance
+	h.phase = signalPhaseSideClear
+	h.phaseTimer = 0
+
+	h.coils[signalFlashReg] = false
+	h.coils[signalManualReg] = false
+	h.coils[signalConflictResetReg] = false
+	h.coils[signalManualLampsReg+signalMainRedReg] = true
+	h.coils[signalManualLampsReg+signalSideRedReg] = true
+
+	return nil
+}
+
+// phaseTime returns the duration of the given phase in seconds
+func (h *TrafficSignalHandler) phaseTime(phase uint16) uint16 {
+	switch phase {
+	case signalPhaseMainGreen:
+		return h.mainGreenTime
+	case signalPhaseMainYellow:
+		return h.mainYellowTime
+	case signalPhaseSideGreen:
+		return h.sideGreenTime
+	case signalPhaseSideYellow:
+		return h.sideYellowTime
+	default:
+		return h.allRedTime
+	}
+}
+
+// phaseLamps returns the lamps lit in the given phase
+func phaseLamps(phase uint16) (lamps [signalLamps]bool) {
+	switch phase {
+	case signalPhaseMainGreen:
+		lamps[signalMainGreenReg] = true
+		lamps[signalSideRedReg] = true
+	case signalPhaseMainYellow:
+		lamps[signalMainYellowReg] = true
+		lamps[signalSideRedReg] = true
+	case signalPhaseSideGreen:
+		lamps[signalMainRedReg] = true
+		lamps[signalSideGreenReg] = true
+	case signalPhaseSideYellow:
+		lamps[signalMainRedReg] = true
+		lamps[signalSideYellowReg] = true
+	default:
+		lamps[signalMainRedReg] = true
+		lamps[signalSideRedReg] = true
+	}
+	return
+}
+
+// conflicting reports whether both approaches show a green or a yellow at the same time
+func conflicting(lamps [signalLamps]bool) bool {
+	main := lamps[signalMainGreenReg] || lamps[signalMainYellowReg]
+	side := lamps[signalSideGreenReg] || lamps[signalSideYellowReg]
+	return main && side
+}
+
+func (h *TrafficSignalHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	// flashing lamps toggle every tick
+	h.flashOn = !h.flashOn
+
+	var manualLamps [signalLamps]bool
+	copy(manualLamps[:], h.coils[signalManualLampsReg:signalManualLampsReg+signalLamps])
+
+	// the conflict reset coil acts as a push button, the conflict
+	// only clears once the commanded lamps are safe again
+	if h.coils[signalConflictResetReg] {
+		h.coils[signalConflictResetReg] = false
+		if h.discreteInputs[signalConflictReg] && !(h.coils[signalManualReg] && conflicting(manualLamps)) {
+			log.Infof("Traffic Signal: conflict reset")
+			h.discreteInputs[signalConflictReg] = false
+			h.phase = signalPhaseSideClear
+			h.phaseTimer = 0
+		}
+	}
+
+	var lamps [signalLamps]bool
+	switch {
+	case h.discreteInputs[signalConflictReg]:
+		// all red flash until the conflict is reset
+		lamps[signalMainRedReg] = h.flashOn
+		lamps[signalSideRedReg] = h.flashOn
+
+	case h.coils[signalFlashReg]:
+		// the main street flashes yellow and the side street flashes red,
+		// leaving flash goes through an all red clearance
+		lamps[signalMainYellowReg] = h.flashOn
+		lamps[signalSideRedReg] = h.flashOn
+		h.phase = signalPhaseSideClear
+		h.phaseTimer = 0
+
+	case h.coils[signalManualReg]:
+		// leaving manual override goes through an all red clearance
+		lamps = manualLamps
+		h.phase = signalPhaseSideClear
+		h.phaseTimer = 0
+
+	default:
+		h.phaseTimer++
+		if h.phaseTimer >= h.phaseTime(h.phase) {
+			h.phase = (h.phase + 1) % signalPhases
+			h.phaseTimer = 0
+			if h.phase == signalPhaseMainGreen {
+				h.cycleCount++
+			}
+			log.Debugf("Traffic Signal Phase: %v", h.phase)
+		}
+		lamps = phaseLamps(h.phase)
+	}
+
+	// the conflict monitor watches the lamps, whatever drives them
+	if !h.discreteInputs[signalConflictReg] && conflicting(lamps) {
+		log.Warnf("Traffic Signal: conflicting greens %v, forcing all red flash", lamps)
+		h.discreteInputs[signalConflictReg] = true
+		h.conflictCount++
+		lamps = [signalLamps]bool{}
+		lamps[signalMainRedReg] = h.flashOn
+		lamps[signalSideRedReg] = h.flashOn
+	}
+
+	copy(h.discreteInputs[:signalLamps], lamps[:])
+	h.discreteInputs[signalFlashingReg] = h.discreteInputs[signalConflictReg] || h.coils[signalFlashReg]
+	log.Debugf("Traffic Signal Lamps: %v", lamps)
+
+	return nil
+}
+
+func (h *TrafficSignalHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *TrafficSignalHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.discreteInputs) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		res = append(res, h.discreteInputs[int(req.Addr)+i])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *TrafficSignalHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		value, minTime, maxTime, _, ok := h.timing(regAddr)
+		if !ok {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+
+		if req.IsWrite {
+			if req.Args[i] < minTime || req.Args[i] > maxTime {
+				err = modbus.ErrIllegalDataValue
+				log.Warnf("Illegal data value: %v", req.Args[i])
+				return
+			}
+			*value = req.Args[i]
+		}
+		res = append(res, *value)
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *TrafficSignalHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+		case signalPhaseReg:
+			res = append(res, h.phase)
+		case signalRemainingReg:
+			res = append(res, h.phaseTime(h.phase)-min(h.phaseTimer, h.phaseTime(h.phase)))
+		case signalCycleCountReg:
+			res = append(res, h.cycleCount)
+		case signalConflictCountReg:
+			res = append(res, h.conflictCount)
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
@@ -0,0 +1,331 @@
+package handler
+
+/*
+* This file contains the handler for the valve positioner simulation. The
+* positioner drives an actuated valve towards its position setpoint at the
+* speed given by its stroke time, and reports the position and the limit
+* switches. The valve can fail stuck or slow, e.g. after a seized stem or a
+* leaking actuator. The positioner is also used by the water tank drain valve.
+ */
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	valveEmergencyCloseReg = 0 // the valve strokes closed, whatever the setpoint
+
+	// Discrete Inputs (Read-Only)
+	valveClosedLimitReg = 0
+	valveOpenLimitReg   = 1
+	valveTravellingReg  = 2
+	valveDeviationReg   = 3 // the valve does not follow its setpoint
+
+	// Holding Registers (Read/Write)
+	valveSetpointReg    = 100 // %
+	valveStrokeTimeReg  = 101 // 0.1 s
+	valveFailureModeReg = 102
+
+	// Input Registers (Read-Only)
+	valvePositionReg = 100 // %
+)
+
+// Valve failure modes
+const (
+	valveFailureNone  = 0
+	valveFailureStuck = 1 // the valve does not move
+	valveFailureSlow  = 2 // the valve strokes at a quarter of its speed
+)
+
+const (
+	// the limit switches trip within this distance of the end of the stroke
+	valveLimitBand = 1 // %
+	// a position further than this from the setpoint raises the deviation alarm
+	valveDeviationBand = 5 // %
+	// the stroke time register holds up to 6553.5 s
+	valveMaxStrokeTime = math.MaxUint16 / 10.0
+)
+
+// valveFailureModes maps the failure modes of the configuration to their values
+var valveFailureModes = map[string]uint16{
+	"":      valveFailureNone,
+	"none":  valveFailureNone,
+	"stuck": valveFailureStuck,
+	"slow":  valveFailureSlow,
+}
+
+// valvePositioner is an actuated valve moving towards its position setpoint
+type valvePositioner struct {
+	strokeTime uint16 // 0.1 s, full stroke
+	setpoint   uint16 // %
+	failure    uint16
+	// emergency close, the valve strokes closed but keeps its setpoint
+	closing bool
+
+	position   float32 // %
+	travelling bool
+}
+
+func newValvePositioner(strokeTime float32, position uint16, failure uint16) *valvePositioner {
+	return &valvePositioner{
+		strokeTime: uint16(strokeTime * 10),
+		setpoint:   position,
+		failure:    failure,
+		position:   float32(position),
+	}
+}
+
+// step moves the valve towards its setpoint for dt seconds
+func (v *valvePositioner) step(dt float32) {
+	speed := float32(math.Inf(1))
+	if v.strokeTime > 0 {
+		speed = 100 / (float32(v.strokeTime) / 10)
+	}
+	switch v.failure {
+	case valveFailureStuck:
+		speed = 0
+	case valveFailureSlow:
+		speed /= 4
+	}
+
+	previous := v.position
+	target := v.target()
+	if v.position < target {
+		v.position = min(target, v.position+speed*dt)
+	} else {
+		v.position = max(target, v.position-speed*dt)
+	}
+	v.travelling = v.position != previous
+}
+
+// target returns the position the valve strokes to, closed on an emergency close
+func (v *valvePositioner) target() float32 {
+	if v.closing {
+		return 0
+	}
+	return float32(v.setpoint)
+}
+
+// closedLimit reports whether the closed limit switch is made
+func (v *valvePositioner) closedLimit() bool {
+	return v.position <= valveLimitBand
+}
+
+// openLimit reports whether the open limit switch is made
+func (v *valvePositioner) openLimit() bool {
+	return v.position >= 100-valveLimitBand
+}
+
+// deviation reports whether the valve stopped away from its target
+func (v *valvePositioner) deviation() bool {
+	return !v.travelling && math.Abs(float64(v.position)-float64(v.target())) > valveDeviationBand
+}
+
+// discreteInput returns the value of the positioner discrete input at the given address
+func (v *valvePositioner) discreteInput(addr uint16) (bool, bool) {
+	switch addr {
+	case valveClosedLimitReg:
+		return v.closedLimit(), true
+	case valveOpenLimitReg:
+		return v.openLimit(), true
+	case valveTravellingReg:
+		return v.travelling, true
+	case valveDeviationReg:
+		return v.deviation(), true
+	}
+	return false, false
+}
+
+// holdingRegister returns the positioner holding register at the given address and its maximum value
+func (v *valvePositioner) holdingRegister(addr uint16) (*uint16, uint16) {
+	switch addr {
+	case valveSetpointReg:
+		return &v.setpoint, 100
+	case valveStrokeTimeReg:
+		return &v.strokeTime, math.MaxUint16
+	case valveFailureModeReg:
+		return &v.failure, valveFailureSlow
+	}
+	return nil, 0
+}
+
+type ValveHandler struct {
+	Lock sync.RWMutex
+
+	coils [10]bool
+
+	valve       *valvePositioner
+	strokeTime  float32 // s
+	failureMode string
+	// setpoint linked by the topology
+	setpointLinked bool
+}
+
+func NewValveHandler(config config.Valve) *ValveHandler {
+	return &ValveHandler{
+		valve:       newValvePositioner(config.StrokeTime, config.InitialPosition, valveFailureModes[config.FailureMode]),
+		strokeTime:  config.StrokeTime,
+		failureMode: config.FailureMode,
+	}
+}
+
+func (h *ValveHandler) Init() error {
+	if h.valve.setpoint > 100 {
+		return fmt.Errorf("valve initial position must be between 0 and 100")
+	}
+	if h.strokeTime < 0 || h.strokeTime > valveMaxStrokeTime {
+		return fmt.Errorf("valve stroke time must be between 0 and %v s", valveMaxStrokeTime)
+	}
+	if _, ok := valveFailureModes[h.failureMode]; !ok {
+		return fmt.Errorf("unknown valve failure mode: %v", h.failureMode)
+	}
+
+	h.coils[valveEmergencyCloseReg] = false
+
+	return nil
+}
+
+// SetInput sets the position setpoint of the valve in percent
+func (h *ValveHandler) SetInput(port string, value float32) bool {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	switch port {
+	case "setpoint":
+		h.setpointLinked = true
+		h.valve.setpoint = uint16(max(0, min(100, value)) + 0.5)
+		return true
+	}
+	return false
+}
+
+// Output returns the position of the valve in percent
+func (h *ValveHandler) Output(port string) (float32, bool) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	switch port {
+	case "position":
+		return h.valve.position, true
+	}
+	return 0, false
+}
+
+func (h *ValveHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	h.valve.closing = h.coils[valveEmergencyCloseReg]
+	h.valve.step(1)
+	log.Debugf("Valve Setpoint: %v, Position: %v", h.valve.setpoint, h.valve.position)
+
+	return nil
+}
+
+func (h *ValveHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *ValveHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		value, ok := h.valve.discreteInput(regAddr)
+		if !ok {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+		res = append(res, value)
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *ValveHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		value, maxValue := h.valve.holdingRegister(regAddr)
+		if value == nil {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+
+		if req.IsWrite {
+			// the setpoint follows the topology when it is linked
+			if req.Args[i] > maxValue || (regAddr == valveSetpointReg && h.setpointLinked) {
+				err = modbus.ErrIllegalDataValue
+				log.Warnf("Illegal data value: %v", req.Args[i])
+				return
+			}
+			*value = req.Args[i]
+		}
+		res = append(res, *value)
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *ValveHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case valvePositionReg:
+			res = append(res, uint16((math.Float32bits(h.valve.position)>>16)&0xffff))
+		case valvePositionReg + 1:
+			res = append(res, uint16((math.Float32bits(h.valve.position))&0xffff))
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
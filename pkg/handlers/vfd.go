@@ -0,0 +1,493 @@
+package handler
+
+/*
+* This file contains the handler for the variable frequency drive and motor
+* simulation. The drive ramps its output frequency towards the setpoint, the
+* induction motor follows it with a slip proportional to the torque, and the
+* conveyor adds a constant load torque plus its inertia. The drive trips on
+* overcurrent and motor overtemperature, letting the motor coast to a stop.
+ */
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	vfdRunReg        = 0
+	vfdReverseReg    = 1 // false for forward, true for reverse
+	vfdFaultResetReg = 2
+
+	// Discrete Inputs (Read-Only)
+	vfdRunningReg   = 0
+	vfdAtSpeedReg   = 1
+	vfdReversingReg = 2
+	vfdFaultedReg   = 3
+	vfdReadyReg     = 4
+
+	// Holding Registers (Read/Write)
+	vfdFrequencySetpointReg = 100 // 0.1 Hz
+	vfdAccelTimeReg         = 101 // 0.1 s, from 0 to the rated frequency
+	vfdDecelTimeReg         = 102 // 0.1 s, from the rated frequency to 0
+	vfdLoadTorqueReg        = 103 // % of the rated torque
+
+	// Input Registers (Read-Only)
+	vfdFrequencyReg   = 100
+	vfdSpeedReg       = 102 // RPM, negative in reverse
+	vfdCurrentReg     = 104
+	vfdTorqueReg      = 106 // Nm
+	vfdTemperatureReg = 108
+	vfdVoltageReg     = 110
+	vfdPowerReg       = 112 // kW
+	vfdFaultCodeReg   = 200
+)
+
+// VFD fault codes
+const (
+	vfdFaultNone            = 0
+	vfdFaultOvercurrent     = 1
+	vfdFaultOvertemperature = 2
+)
+
+const (
+	vfdAmbient = 25
+	// magnetizing current of the motor
+	vfdMagnetizingCurrent = 0.35 // of the rated current
+	vfdEfficiency         = 0.92
+	// steady state temperature rise at the rated current and thermal time constant of the motor
+	vfdTemperatureRise = 80  // K
+	vfdThermalTime     = 600 // seconds
+	// the shaft fan cools less at low speed
+	vfdStandstillCooling = 0.3
+	// friction of the motor and the conveyor when coasting
+	vfdFrictionTorque = 0.02 // of the rated torque
+	// the protection limits when they are not configured
+	vfdDefaultOvercurrentLimit = 150 // % of the rated current
+	vfdDefaultMaxTemperature   = 140 // C, a class F winding with margin
+	// the longest ramp time held by the 0.1 s ramp time registers
+	vfdMaxRampTime = math.MaxUint16 / 10.0 // seconds
+)
+
+type VFDHandler struct {
+	Lock sync.RWMutex
+
+	coils          [10]bool
+	discreteInputs [10]bool
+
+	ratedPower       float32 // kW
+	ratedVoltage     float32
+	ratedCurrent     float32
+	ratedFrequency   float32
+	ratedSpeed       float32 // RPM
+	maxFrequency     float32
+	inertia          float32 // kg.m2 of the motor and the conveyor
+	overcurrentLimit float32 // % of the rated current
+	maxTemperature   float32
+
+	// derived from the rated values
+	poles       float32
+	ratedSlip   float32
+	ratedTorque float32 // Nm
+
+	// ramp times of the configuration in s, checked against the range of their registers in Init
+	accelSeconds float32
+	decelSeconds float32
+
+	frequencySetpoint uint16 // 0.1 Hz
+	accelTime         uint16 // 0.1 s
+	decelTime         uint16 // 0.1 s
+	loadTorque        uint16 // %
+
+	frequency   float32 // Hz, negative in reverse
+	speed       float32 // RPM, negative in reverse
+	current     float32
+	torque      float32 // Nm
+	temperature float32
+	voltage     float32
+	power       float32 // kW
+	faultCode   uint16
+}
+
+func NewVFDHandler(config config.VFD) *VFDHandler {
+	return &VFDHandler{
+		ratedPower:       config.RatedPower,
+		ratedVoltage:     config.RatedVoltage,
+		ratedCurrent:     config.RatedCurrent,
+		ratedFrequency:   config.RatedFrequency,
+		ratedSpeed:       config.RatedSpeed,
+		maxFrequency:     config.MaxFrequency,
+		inertia:          config.Inertia,
+		overcurrentLimit: float32(config.OvercurrentLimit),
+		maxTemperature:   config.MaxTemperature,
+		accelSeconds:     config.AccelTime,
+		decelSeconds:     config.DecelTime,
+		loadTorque:       config.LoadTorque,
+	}
+}
+
+// Power returns the power drawn by the drive in W
+func (h *VFDHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return h.power * 1000
+}
+
+// Output returns the value of the named topology output
+func (h *VFDHandler) Output(port string) (float32, bool) {
+	switch port {
+	case "power":
+		return h.Power(), true
+	}
+	return 0, false
+}
+
+func (h *VFDHandler) Init() error {
+	if h.ratedPower <= 0 || h.ratedCurrent <= 0 || h.ratedFrequency <= 0 {
+		return fmt.Errorf("VFD rated power, current and frequency must be positive")
+	}
+	// a two pole motor turns below 60 times the rated frequency
+	if h.ratedSpeed <= 0 || h.ratedSpeed >= 60*h.ratedFrequency {
+		return fmt.Errorf("VFD rated speed must be between 0 and %v RPM", 60*h.ratedFrequency)
+	}
+	if h.accelSeconds < 0 || h.accelSeconds > vfdMaxRampTime || h.decelSeconds < 0 || h.decelSeconds > vfdMaxRampTime {
+		return fmt.Errorf("VFD acceleration and deceleration times must be between 0 and %v s", vfdMaxRampTime)
+	}
+
+	// the number of poles is the one giving the synchronous speed just above the rated speed
+	h.poles = 2 * float32(math.Floor(float64(60*h.ratedFrequency/h.ratedSpeed)))
+	h.ratedSlip = 1 - h.ratedSpeed/(120*h.ratedFrequency/h.poles)
+	h.ratedTorque = h.ratedPower * 1000 / (h.ratedSpeed * 2 * math.Pi / 60)
+	log.Debugf("VFD Poles: %v, Rated Slip: %v, Rated Torque: %v", h.poles, h.ratedSlip, h.ratedTorque)
+
+	if h.inertia <= 0 {
+		h.inertia = 0.1
+	}
+	if h.maxFrequency == 0 {
+		h.maxFrequency = h.ratedFrequency
+	}
+	// the protections would trip the drive as soon as it runs without their limits
+	if h.overcurrentLimit == 0 {
+		h.overcurrentLimit = vfdDefaultOvercurrentLimit
+	}
+	if h.maxTemperature == 0 {
+		h.maxTemperature = vfdDefaultMaxTemperature
+	}
+	if h.overcurrentLimit <= 100 || h.maxTemperature <= vfdAmbient {
+		return fmt.Errorf("VFD overcurrent limit must be above 100%% and max temperature above %v C", vfdAmbient)
+	}
+	h.accelTime = max(1, uint16(math.Round(float64(h.accelSeconds)*10)))
+	h.decelTime = max(1, uint16(math.Round(float64(h.decelSeconds)*10)))
+	h.frequencySetpoint = uint16(h.ratedFrequency * 10)
+	h.temperature = vfdAmbient
+
+	h.coils[vfdRunReg] = false
+	h.coils[vfdReverseReg] = false
+	h.coils[vfdFaultResetReg] = false
+
+	return nil
+}
+
+// fault stops the drive output and records the fault code, the motor coasts to a stop
+func (h *VFDHandler) fault(code uint16) {
+	log.Warnf("VFD: fault %v at %v A, %v C", code, h.current, h.temperature)
+	h.faultCode = code
+	h.frequency = 0
+	// the run command has to be given again after the fault is reset
+	h.coils[vfdRunReg] = false
+}
+
+// ramp moves the output frequency towards the target frequency along the acceleration and deceleration ramps
+func (h *VFDHandler) ramp(target float32) {
+	accel := h.ratedFrequency / (float32(h.accelTime) / 10)
+	decel := h.ratedFrequency / (float32(h.decelTime) / 10)
+
+	// the drive decelerates whenever it moves towards standstill
+	step := accel
+	if (h.frequency > 0 && target < h.frequency) || (h.frequency < 0 && target > h.frequency) {
+		step = decel
+	}
+
+	next := target
+	if target > h.frequency {
+		next = min(target, h.frequency+step)
+	} else if target < h.frequency {
+		next = max(target, h.frequency-step)
+	}
+
+	// reversing goes through standstill
+	if (h.frequency > 0 && next < 0) || (h.frequency < 0 && next > 0) {
+		next = 0
+	}
+	h.frequency = next
+}
+
+func (h *VFDHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	// the fault reset coil acts as a push button
+	if h.coils[vfdFaultResetReg] {
+		h.coils[vfdFaultResetReg] = false
+		if h.faultCode != vfdFaultNone {
+			log.Infof("VFD: fault %v reset", h.faultCode)
+			h.faultCode = vfdFaultNone
+		}
+	}
+
+	faulted := h.faultCode != vfdFaultNone
+	load := float32(h.loadTorque) / 100 * h.ratedTorque
+
+	// catch a spinning motor when the drive starts while it is still coasting
+	if !faulted && h.frequency == 0 && h.speed != 0 {
+		h.frequency = h.speed * h.poles / 120
+	}
+	previousFrequency := h.frequency
+
+	if !faulted {
+		target := float32(0)
+		if h.coils[vfdRunReg] {
+			target = float32(h.frequencySetpoint) / 10
+			if h.coils[vfdReverseReg] {
+				target = -target
+			}
+		}
+
+		h.ramp(target)
+		log.Debugf("VFD Target: %v, Frequency: %v", target, h.frequency)
+	}
+
+	// the conveyor load always opposes the motion
+	direction := float32(0)
+	if h.frequency > 0 || (faulted && h.speed > 0) {
+		direction = 1
+	} else if h.frequency < 0 || (faulted && h.speed < 0) {
+		direction = -1
+	}
+
+	if faulted {
+		// without the drive output the motor coasts, slowed down by the load and the friction
+		deceleration := (load + vfdFrictionTorque*h.ratedTorque) / h.inertia * 60 / (2 * math.Pi)
+		if h.speed > 0 {
+			h.speed = max(0, h.speed-deceleration)
+		} else {
+			h.speed = min(0, h.speed+deceleration)
+		}
+		h.torque = 0
+	} else {
+		// the motor torque overcomes the load and accelerates the inertia, the
+		// acceleration torque follows the ramp over the last tick
+		synchronous := 120 * h.frequency / h.poles
+		acceleration := 120 * (h.frequency - previousFrequency) / h.poles * 2 * math.Pi / 60
+		h.torque = direction*load + h.inertia*acceleration
+		h.speed = synchronous * (1 - h.ratedSlip*direction*h.torque/h.ratedTorque)
+		if h.frequency == 0 {
+			h.speed = 0
+			h.torque = 0
+		}
+	}
+
+	// the drive holds the V/f ratio up to the rated frequency, and weakens the field above it
+	f := float32(math.Abs(float64(h.frequency)))
+	h.voltage = h.ratedVoltage * min(1, f/h.ratedFrequency)
+	torqueCurrent := float32(math.Abs(float64(h.torque))) / h.ratedTorque * h.ratedCurrent * float32(math.Sqrt(1-vfdMagnetizingCurrent*vfdMagnetizingCurrent))
+	torqueCurrent *= max(1, f/h.ratedFrequency)
+	h.current = 0
+	if f > 0 {
+		h.current = float32(math.Hypot(float64(vfdMagnetizingCurrent*h.ratedCurrent), float64(torqueCurrent)))
+	}
+	h.power = max(0, h.torque*h.speed*2*math.Pi/60/1000/vfdEfficiency)
+	log.Debugf("VFD Speed: %v, Torque: %v, Current: %v", h.speed, h.torque, h.current)
+
+	// the motor heats up with the square of the current and cools down towards the ambient temperature
+	cooling := vfdStandstillCooling + (1-vfdStandstillCooling)*min(1, float32(math.Abs(float64(h.speed)))/h.ratedSpeed)
+	heat := vfdTemperatureRise * (h.current / h.ratedCurrent) * (h.current / h.ratedCurrent)
+	h.temperature += (heat - (h.temperature-vfdAmbient)*cooling) / vfdThermalTime
+	log.Debugf("VFD Temperature: %v", h.temperature)
+
+	// protections
+	if !faulted {
+		switch {
+		case h.current > h.overcurrentLimit/100*h.ratedCurrent:
+			h.fault(vfdFaultOvercurrent)
+		case h.temperature > h.maxTemperature:
+			h.fault(vfdFaultOvertemperature)
+		}
+	}
+
+	h.discreteInputs[vfdRunningReg] = h.frequency != 0
+	h.discreteInputs[vfdAtSpeedReg] = h.coils[vfdRunReg] && h.faultCode == vfdFaultNone &&
+		float32(math.Abs(float64(h.frequency))) == float32(h.frequencySetpoint)/10
+	h.discreteInputs[vfdReversingReg] = h.frequency < 0
+	h.discreteInputs[vfdFaultedReg] = h.faultCode != vfdFaultNone
+	h.discreteInputs[vfdReadyReg] = h.faultCode == vfdFaultNone
+
+	return nil
+}
+
+func (h *VFDHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *VFDHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.discreteInputs) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		res = append(res, h.discreteInputs[int(req.Addr)+i])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *VFDHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		switch regAddr {
+		case vfdFrequencySetpointReg:
+			if req.IsWrite {
+				if float32(req.Args[i]) > h.maxFrequency*10 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.frequencySetpoint = req.Args[i]
+			}
+			res = append(res, h.frequencySetpoint)
+
+		case vfdAccelTimeReg:
+			if req.IsWrite {
+				if req.Args[i] == 0 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.accelTime = req.Args[i]
+			}
+			res = append(res, h.accelTime)
+
+		case vfdDecelTimeReg:
+			if req.IsWrite {
+				if req.Args[i] == 0 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.decelTime = req.Args[i]
+			}
+			res = append(res, h.decelTime)
+
+		case vfdLoadTorqueReg:
+			if req.IsWrite {
+				h.loadTorque = req.Args[i]
+			}
+			res = append(res, h.loadTorque)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *VFDHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case vfdFrequencyReg:
+			res = append(res, uint16((math.Float32bits(h.frequency)>>16)&0xffff))
+		case vfdFrequencyReg + 1:
+			res = append(res, uint16((math.Float32bits(h.frequency))&0xffff))
+
+		case vfdSpeedReg:
+			res = append(res, uint16((math.Float32bits(h.speed)>>16)&0xffff))
+		case vfdSpeedReg + 1:
+			res = append(res, uint16((math.Float32bits(h.speed))&0xffff))
+
+		case vfdCurrentReg:
+			res = append(res, uint16((math.Float32bits(h.current)>>16)&0xffff))
+		case vfdCurrentReg + 1:
+			res = append(res, uint16((math.Float32bits(h.current))&0xffff))
+
+		case vfdTorqueReg:
+			res = append(res, uint16((math.Float32bits(h.torque)>>16)&0xffff))
+		case vfdTorqueReg + 1:
+			res = append(res, uint16((math.Float32bits(h.torque))&0xffff))
+
+		case vfdTemperatureReg:
+			res = append(res, uint16((math.Float32bits(h.temperature)>>16)&0xffff))
+		case vfdTemperatureReg + 1:
+			res = append(res, uint16((math.Float32bits(h.temperature))&0xffff))
+
+		case vfdVoltageReg:
+			res = append(res, uint16((math.Float32bits(h.voltage)>>16)&0xffff))
+		case vfdVoltageReg + 1:
+			res = append(res, uint16((math.Float32bits(h.voltage))&0xffff))
+
+		case vfdPowerReg:
+			res = append(res, uint16((math.Float32bits(h.power)>>16)&0xffff))
+		case vfdPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.power))&0xffff))
+
+		case vfdFaultCodeReg:
+			res = append(res, h.faultCode)
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
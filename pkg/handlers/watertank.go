@@ -4,9 +4,13 @@ package handler
 * This file contains the handler for the water level simulation.
 * The handler is responsible for filling the water tank and draining it.
 * The handler also contains the logic for the water level sensor.
+* The drain cannot take out more water than the tank holds, and the water
+* flowing in above the capacity of the tank spills over its top.
  */
 
 import (
+	"fmt"
+	"math"
 	"math/rand"
 	"sync"
 
@@ -21,6 +25,10 @@ const (
 	valveStateReg   = 1
 	pumpStateReg    = 2
 
+	// Discrete Inputs (Read-Only), the drain valve positioner ones are at 0 to 3
+	tankDryReg      = 4
+	tankSpillingReg = 5
+
 	// Input Registers (Read-Only)
 	waterLevelReg         = 100
 	maxTankCapacityReg    = 101
@@ -29,6 +37,14 @@ const (
 	maxWaterLevelAlarmReg = 104
 	drainRateReg          = 105
 	fillRateReg           = 106
+	pumpPowerReg          = 107
+	drainValvePositionReg = 108 // %, only with a drain valve positioner
+	levelPercentReg       = 109 // 0.1 %
+	volumeReg             = 110 // L, float32
+	levelReg              = 112 // %, float32
+	inflowReg             = 114 // L/s, float32
+	outflowReg            = 116 // L/s, float32
+	spillReg              = 118 // L/s, float32
 )
 
 type WaterTankHandler struct {
@@ -36,28 +52,69 @@ type WaterTankHandler struct {
 
 	coils [10]bool
 
-	maxTankCapacity     uint16
-	maxWaterLevel       uint16 // Turn off the pump when the water level reaches this value
-	minWaterLevel       uint16 // Turn on the pump when the water level reaches this value
-	maxWaterLevelAlarm  uint16 // Forcefully turn off the pump when the water level reaches this value
-	waterLevel          uint16
-	drainRate           uint16
-	calculatedDrainRate uint16
-	fillRate            uint16
+	maxTankCapacity    uint16
+	maxWaterLevel      uint16 // Turn off the pump when the water level reaches this value
+	minWaterLevel      uint16 // Turn on the pump when the water level reaches this value
+	maxWaterLevelAlarm uint16 // Forcefully turn off the pump when the water level reaches this value
+	drainRate          uint16
+	fillRate           uint16
+	pumpPower          uint16 // W
+
+	volume  float32 // L
+	dry     bool
+	outflow float32 // L/s through the drain valve
+	spill   float32 // L/s over the top of the tank
+	// total flow into the tank, from the pump and the topology
+	totalInflow float32 // L/s
+
+	// flow linked to the inflow by the topology
+	inflow float32 // L/s
+
+	// pump speed linked by the topology, it replaces the automatic mode
+	pumpSpeedLinked bool
+	pumpSpeed       float32 // %
+
+	// the pump only runs while its supply is energised, e.g. through a breaker
+	energised bool
+
+	// actuated drain valve, nil when the drain valve opens and closes instantly
+	drainValve           *valvePositioner
+	drainValveStrokeTime float32 // s
+	// last state of the valve coil, a change of the coil moves the valve setpoint
+	valveCommand bool
 }
 
 func NewWaterTankHandler(config config.WaterTank) *WaterTankHandler {
-	return &WaterTankHandler{
+	h := &WaterTankHandler{
 		maxTankCapacity:    config.MaxTankCapacity,
 		maxWaterLevel:      config.MaxWaterLevel,
 		minWaterLevel:      config.MinWaterLevel,
 		maxWaterLevelAlarm: config.MaxWaterLevelAlarm,
 		drainRate:          config.DrainRate,
 		fillRate:           config.FillRate,
+		pumpPower:          config.PumpPower,
+
+		drainValveStrokeTime: config.DrainValveStrokeTime,
 	}
+
+	if config.DrainValveStrokeTime > 0 {
+		h.drainValve = newValvePositioner(config.DrainValveStrokeTime, 0, valveFailureNone)
+	}
+
+	return h
 }
 
 func (h *WaterTankHandler) Init() error {
+	if h.maxTankCapacity == 0 {
+		return fmt.Errorf("water tank max tank capacity must be set")
+	}
+	if h.drainValveStrokeTime > valveMaxStrokeTime {
+		return fmt.Errorf("water tank drain valve stroke time must be up to %v s", valveMaxStrokeTime)
+	}
+
+	h.volume = 0
+	h.dry = true
+	h.energised = true
 
 	h.coils[selectedModeReg] = true // false for manual mode, true for automatic mode
 	h.coils[valveStateReg] = false  // false for closed, true for open - drains the tank
@@ -66,12 +123,95 @@ func (h *WaterTankHandler) Init() error {
 	return nil
 }
 
+// Power returns the electrical power drawn by the pump in W
+func (h *WaterTankHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	return h.pumpDraw()
+}
+
+// pumpRunning reports whether the pump is on and its supply is energised
+func (h *WaterTankHandler) pumpRunning() bool {
+	return h.coils[pumpStateReg] && h.energised
+}
+
+// pumpDraw returns the power drawn by the pump in W, a linked pump speed
+// scales the power with the cube of the speed
+func (h *WaterTankHandler) pumpDraw() float32 {
+	if !h.pumpRunning() {
+		return 0
+	}
+	if h.pumpSpeedLinked {
+		speed := h.pumpSpeed / 100
+		return float32(h.pumpPower) * speed * speed * speed
+	}
+	return float32(h.pumpPower)
+}
+
+// Energised reports whether the supply of the pump is energised
+func (h *WaterTankHandler) Energised() bool {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return h.energised
+}
+
+// SetInput sets the named topology input, the inflow is the flow of water
+// into the tank in L/s, the pump speed is in percent of the fill rate and
+// the supply is energised above 0.5
+func (h *WaterTankHandler) SetInput(port string, value float32) bool {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	switch port {
+	case "inflow":
+		h.inflow = value
+		return true
+	case "pump_speed":
+		h.pumpSpeedLinked = true
+		h.pumpSpeed = max(0, min(100, value))
+		return true
+	case "supply":
+		h.energised = value >= 0.5
+		return true
+	}
+	return false
+}
+
+// level returns the water level in percent of the tank capacity
+func (h *WaterTankHandler) level() float32 {
+	return h.volume / float32(h.maxTankCapacity) * 100
+}
+
+// Output returns the value of the named topology output: the outflow through
+// the drain valve in L/s, the spill over the top of the tank in L/s, the
+// water level in percent or the pump power in W
+func (h *WaterTankHandler) Output(port string) (float32, bool) {
+	switch port {
+	case "outflow":
+		h.Lock.RLock()
+		defer h.Lock.RUnlock()
+		return h.outflow, true
+	case "spill":
+		h.Lock.RLock()
+		defer h.Lock.RUnlock()
+		return h.spill, true
+	case "level":
+		h.Lock.RLock()
+		defer h.Lock.RUnlock()
+		return h.level(), true
+	case "power":
+		return h.Power(), true
+	}
+	return 0, false
+}
+
 func (h *WaterTankHandler) Update() error {
 	h.Lock.Lock()
 	defer h.Lock.Unlock()
 
-	waterLevelPercent := float32(h.waterLevel) / float32(h.maxTankCapacity) * 100
-	log.Debugf("Water Level: %v", h.waterLevel)
+	waterLevelPercent := h.level()
+	log.Debugf("Water Level: %v", h.volume)
 	log.Debugf("Water Level Percentage: %v", waterLevelPercent)
 
 	// we do not care about the selected mode in this case
@@ -81,9 +221,11 @@ func (h *WaterTankHandler) Update() error {
 		h.coils[pumpStateReg] = false
 	}
 
-	// if the selected mode is automatic
-	if h.coils[selectedModeReg] {
-
+	// a linked pump speed runs the pump, e.g. from a PID loop holding the level
+	if h.pumpSpeedLinked {
+		h.coils[pumpStateReg] = h.pumpSpeed > 0 && waterLevelPercent < float32(h.maxWaterLevelAlarm)
+	} else if h.coils[selectedModeReg] {
+		// the selected mode is automatic
 		if waterLevelPercent >= float32(h.maxWaterLevel) {
 			h.coils[pumpStateReg] = false
 		}
@@ -96,19 +238,52 @@ func (h *WaterTankHandler) Update() error {
 
 	// valve state is always maintained by the user
 	log.Debugf("Valve State: %v", h.coils[valveStateReg])
+	opening := float64(0)
 	if h.coils[valveStateReg] {
-		h.calculatedDrainRate = uint16(float64(h.drainRate) * (0.9 + 0.2*rand.Float64()))
-		log.Debugf("Calculated Drain Rate: %v", h.calculatedDrainRate)
-		h.waterLevel -= h.calculatedDrainRate
-	} else {
-		// if the valve is closed, the drain rate is 0
-		h.calculatedDrainRate = 0
+		opening = 1
 	}
 
-	log.Debugf("Pump State: %v", h.coils[pumpStateReg])
-	if h.coils[pumpStateReg] {
-		h.waterLevel += h.fillRate
+	// the actuated drain valve strokes towards its setpoint, opening or
+	// closing the valve with the coil moves the setpoint to the end of the stroke
+	if h.drainValve != nil {
+		if h.coils[valveStateReg] != h.valveCommand {
+			h.valveCommand = h.coils[valveStateReg]
+			h.drainValve.setpoint = 0
+			if h.valveCommand {
+				h.drainValve.setpoint = 100
+			}
+		}
+		h.drainValve.step(1)
+		opening = float64(h.drainValve.position) / 100
+		log.Debugf("Drain Valve Setpoint: %v, Position: %v", h.drainValve.setpoint, h.drainValve.position)
+	}
+
+	// the water flowing in over the one second tick, from the pump and the topology
+	log.Debugf("Pump State: %v, Energised: %v", h.coils[pumpStateReg], h.energised)
+	h.totalInflow = max(0, h.inflow)
+	if h.pumpRunning() {
+		if h.pumpSpeedLinked {
+			h.totalInflow += float32(h.fillRate) * h.pumpSpeed / 100
+		} else {
+			h.totalInflow += float32(h.fillRate)
+		}
 	}
+	h.volume += h.totalInflow
+	log.Debugf("Inflow: %v", h.totalInflow)
+
+	// the drain cannot take out more water than the tank holds
+	h.outflow = 0
+	if opening > 0 {
+		h.outflow = min(h.volume, float32(float64(h.drainRate)*opening*(0.9+0.2*rand.Float64())))
+	}
+	h.volume -= h.outflow
+	log.Debugf("Calculated Drain Rate: %v", h.outflow)
+
+	// the excess spills over the top of the tank
+	h.spill = max(0, h.volume-float32(h.maxTankCapacity))
+	h.volume = max(0, h.volume-h.spill)
+	h.dry = h.volume == 0
+	log.Debugf("Spill: %v, Dry: %v", h.spill, h.dry)
 
 	return nil
 }
@@ -138,24 +313,81 @@ func (h *WaterTankHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, er
 }
 
 func (h *WaterTankHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
-	err = modbus.ErrIllegalFunction
-	log.Warn("Illegal function: DiscreteInputs")
-	return res, err
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		var value, ok bool
+		switch {
+		case regAddr == tankDryReg:
+			value, ok = h.dry, true
+		case regAddr == tankSpillingReg:
+			value, ok = h.spill > 0, true
+		case h.drainValve != nil:
+			value, ok = h.drainValve.discreteInput(regAddr)
+		}
+		if !ok {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+		res = append(res, value)
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
 }
 
 func (h *WaterTankHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
-	err = modbus.ErrIllegalFunction
-	log.Warn("Illegal function: HoldingRegisters")
-	return res, err
+	// the holding registers are the drain valve positioner ones
+	if h.drainValve == nil {
+		err = modbus.ErrIllegalFunction
+		log.Warn("Illegal function: HoldingRegisters")
+		return res, err
+	}
+
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		value, maxValue := h.drainValve.holdingRegister(regAddr)
+		if value == nil {
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+
+		if req.IsWrite {
+			if req.Args[i] > maxValue {
+				err = modbus.ErrIllegalDataValue
+				log.Warnf("Illegal data value: %v", req.Args[i])
+				return
+			}
+			*value = req.Args[i]
+		}
+		res = append(res, *value)
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
 }
 
 func (h *WaterTankHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
 
 	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
 		switch regAddr {
 
 		case waterLevelReg:
-			res = append(res, h.waterLevel)
+			res = append(res, uint16(h.volume+0.5))
 
 		case maxTankCapacityReg:
 			res = append(res, h.maxTankCapacity)
@@ -170,11 +402,50 @@ func (h *WaterTankHandler) HandleInputRegisters(req *modbus.InputRegistersReques
 			res = append(res, h.maxWaterLevelAlarm)
 
 		case drainRateReg:
-			res = append(res, h.calculatedDrainRate)
+			res = append(res, uint16(h.outflow+0.5))
 
 		case fillRateReg:
 			res = append(res, h.fillRate)
 
+		case pumpPowerReg:
+			res = append(res, uint16(h.pumpDraw()))
+
+		case drainValvePositionReg:
+			if h.drainValve == nil {
+				log.Warnf("Illegal data address: %v", regAddr)
+				err = modbus.ErrIllegalDataAddress
+				return
+			}
+			res = append(res, uint16(h.drainValve.position+0.5))
+
+		case levelPercentReg:
+			res = append(res, uint16(h.level()*10+0.5))
+
+		case volumeReg:
+			res = append(res, uint16((math.Float32bits(h.volume)>>16)&0xffff))
+		case volumeReg + 1:
+			res = append(res, uint16((math.Float32bits(h.volume))&0xffff))
+
+		case levelReg:
+			res = append(res, uint16((math.Float32bits(h.level())>>16)&0xffff))
+		case levelReg + 1:
+			res = append(res, uint16((math.Float32bits(h.level()))&0xffff))
+
+		case inflowReg:
+			res = append(res, uint16((math.Float32bits(h.totalInflow)>>16)&0xffff))
+		case inflowReg + 1:
+			res = append(res, uint16((math.Float32bits(h.totalInflow))&0xffff))
+
+		case outflowReg:
+			res = append(res, uint16((math.Float32bits(h.outflow)>>16)&0xffff))
+		case outflowReg + 1:
+			res = append(res, uint16((math.Float32bits(h.outflow))&0xffff))
+
+		case spillReg:
+			res = append(res, uint16((math.Float32bits(h.spill)>>16)&0xffff))
+		case spillReg + 1:
+			res = append(res, uint16((math.Float32bits(h.spill))&0xffff))
+
 		default:
 			log.Warnf("Illegal data address: %v", regAddr)
 			err = modbus.ErrIllegalDataAddress
@@ -0,0 +1,456 @@
+package handler
+
+/*
+* This file contains the handler for the water treatment simulation. Sodium
+* hypochlorite and sodium hydroxide (caustic) are dosed into a contact tank,
+* modelled as a continuously stirred tank. The residual chlorine decays with
+* the chlorine demand of the water, and the pH follows the carbonate
+* equilibrium of the raw water buffered by its alkalinity.
+ */
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	treatmentChlorinePumpReg = 0
+	treatmentCausticPumpReg  = 1
+	treatmentAutoModeReg     = 2 // false for manual pump speeds, true for flow-proportional dosing
+
+	// Discrete Inputs (Read-Only)
+	treatmentChlorineLowReg     = 0
+	treatmentChlorineHighReg    = 1
+	treatmentPHLowReg           = 2
+	treatmentPHHighReg          = 3
+	treatmentNoFlowReg          = 4
+	treatmentChlorineRunningReg = 5
+	treatmentCausticRunningReg  = 6
+
+	// Holding Registers (Read/Write)
+	treatmentChlorineDoseReg      = 100 // 0.01 mg/L
+	treatmentCausticDoseReg       = 101 // mg/L
+	treatmentChlorinePumpSpeedReg = 102 // 0.1 %
+	treatmentCausticPumpSpeedReg  = 103 // 0.1 %
+	treatmentChlorineLowAlarmReg  = 104 // 0.01 mg/L
+	treatmentChlorineHighAlarmReg = 105 // 0.01 mg/L
+	treatmentPHLowAlarmReg        = 106 // 0.01 pH
+	treatmentPHHighAlarmReg       = 107 // 0.01 pH
+
+	// Input Registers (Read-Only)
+	treatmentFlowReg             = 100 // L/s
+	treatmentChlorineReg         = 102 // mg/L
+	treatmentPHReg               = 104
+	treatmentChlorinePumpRateReg = 106 // L/h
+	treatmentCausticPumpRateReg  = 108 // L/h
+	treatmentCausticReg          = 110 // mg/L
+)
+
+const (
+	// first order decay of the residual chlorine caused by the chlorine demand of the water
+	chlorineDecay = 0.0002 // 1/s
+	// carbonate system constants at 25 C
+	carbonicPKa1 = 6.35
+	carbonicPKa2 = 10.33
+	waterKw      = 1e-14
+	// molar mass of NaOH and equivalent weight of CaCO3
+	causticMolarMass     = 40000 // mg/mol
+	alkalinityEquivalent = 50000 // mg/eq
+	// below this flow the treatment reports a no flow condition
+	treatmentMinFlow = 0.01 // L/s
+)
+
+type WaterTreatmentHandler struct {
+	Lock sync.RWMutex
+
+	coils          [10]bool
+	discreteInputs [10]bool
+
+	nominalFlow           float32 // L/s, used when no flow is linked to the inflow
+	contactVolume         float32 // L
+	rawPH                 float32
+	alkalinity            float32 // mg/L as CaCO3
+	chlorineConcentration float32 // g/L of the hypochlorite solution
+	causticConcentration  float32 // g/L of the caustic solution
+	chlorinePumpCapacity  float32 // L/h
+	causticPumpCapacity   float32 // L/h
+
+	// total carbonate of the raw water in mol/L, derived from its pH and alkalinity
+	carbonate float64
+
+	chlorineDose      uint16 // 0.01 mg/L
+	causticDose       uint16 // mg/L
+	chlorinePumpSpeed uint16 // 0.1 %
+	causticPumpSpeed  uint16 // 0.1 %
+	chlorineLowAlarm  uint16 // 0.01 mg/L
+	chlorineHighAlarm uint16 // 0.01 mg/L
+	pHLowAlarm        uint16 // 0.01 pH
+	pHHighAlarm       uint16 // 0.01 pH
+
+	// flow linked to the inflow by the topology, updated every tick
+	inflow       float32 // L/s
+	inflowLinked bool
+
+	flow             float32 // L/s
+	chlorine         float32 // mg/L
+	caustic          float32 // mg/L of NaOH added to the water
+	pH               float32
+	chlorinePumpRate float32 // L/h
+	causticPumpRate  float32 // L/h
+}
+
+func NewWaterTreatmentHandler(config config.WaterTreatment) *WaterTreatmentHandler {
+	return &WaterTreatmentHandler{
+		nominalFlow:           config.Flow,
+		contactVolume:         config.ContactVolume,
+		rawPH:                 config.RawPH,
+		alkalinity:            config.Alkalinity,
+		chlorineConcentration: config.ChlorineConcentration,
+		causticConcentration:  config.CausticConcentration,
+		chlorinePumpCapacity:  config.ChlorinePumpCapacity,
+		causticPumpCapacity:   config.CausticPumpCapacity,
+		chlorineDose:          uint16(config.ChlorineDose * 100),
+		causticDose:           uint16(config.CausticDose),
+		chlorineLowAlarm:      uint16(config.ChlorineLowAlarm * 100),
+		chlorineHighAlarm:     uint16(config.ChlorineHighAlarm * 100),
+		pHLowAlarm:            uint16(config.PHLowAlarm * 100),
+		pHHighAlarm:           uint16(config.PHHighAlarm * 100),
+	}
+}
+
+// SetInput sets the named topology input, the inflow is the flow of water to treat in L/s
+func (h *WaterTreatmentHandler) SetInput(port string, value float32) bool {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	switch port {
+	case "inflow":
+		h.inflow = value
+		h.inflowLinked = true
+		return true
+	}
+	return false
+}
+
+// Output returns the value of the named topology output, the flow is the treated water in L/s
+func (h *WaterTreatmentHandler) Output(port string) (float32, bool) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	switch port {
+	case "flow":
+		return h.flow, true
+	}
+	return 0, false
+}
+
+func (h *WaterTreatmentHandler) Init() error {
+	// the concentrations in the tank are divided by its volume, and the pump
+	// speeds by the solution concentrations and the pump capacities
+	if h.contactVolume <= 0 {
+		return fmt.Errorf("water treatment contact volume must be positive")
+	}
+	if h.chlorineConcentration <= 0 || h.causticConcentration <= 0 {
+		return fmt.Errorf("water treatment chlorine and caustic concentrations must be positive")
+	}
+	if h.chlorinePumpCapacity <= 0 || h.causticPumpCapacity <= 0 {
+		return fmt.Errorf("water treatment chlorine and caustic pump capacities must be positive")
+	}
+	if h.rawPH <= 0 || h.rawPH >= 14 || h.alkalinity < 0 {
+		return fmt.Errorf("water treatment raw pH must be between 0 and 14, with a non-negative alkalinity")
+	}
+
+	// the total carbonate of the raw water follows from the charge balance at its pH
+	hydrogen := math.Pow(10, -float64(h.rawPH))
+	alkalinity := float64(h.alkalinity) / alkalinityEquivalent
+	// the alkalinity holds at least the hydroxide of the raw water, within a
+	// rounding margin so pure water at a neutral pH is accepted
+	if hydroxide := waterKw/hydrogen - hydrogen; alkalinity < hydroxide-1e-9 {
+		return fmt.Errorf("water treatment alkalinity is too low for a raw pH of %v", h.rawPH)
+	}
+	h.carbonate = max(0, (alkalinity-waterKw/hydrogen+hydrogen)/carbonateFactor(hydrogen))
+	h.pH = h.rawPH
+
+	h.coils[treatmentChlorinePumpReg] = true
+	h.coils[treatmentCausticPumpReg] = true
+	h.coils[treatmentAutoModeReg] = true
+
+	return nil
+}
+
+// carbonateFactor returns the equivalents of alkalinity per mole of total carbonate at the given hydrogen ion activity
+func carbonateFactor(hydrogen float64) float64 {
+	k1 := math.Pow(10, -carbonicPKa1)
+	k2 := math.Pow(10, -carbonicPKa2)
+	d := hydrogen*hydrogen + k1*hydrogen + k1*k2
+	return (k1*hydrogen + 2*k1*k2) / d
+}
+
+// stirredTank returns the concentration after the one second tick of a
+// continuously stirred tank fed with the given mass rate per litre (mg/L/s)
+// and losing the given rate (1/s) of its concentration. The exact solution
+// stays stable however fast the tank is washed out, where a forward step
+// would overshoot once the rate exceeds 2/s.
+func stirredTank(concentration float32, feed float32, rate float32) float32 {
+	if rate <= 0 {
+		return concentration + feed
+	}
+	steady := feed / rate
+	return steady + (concentration-steady)*float32(math.Exp(-float64(rate)))
+}
+
+// equilibriumPH solves the charge balance of the carbonate system for the pH
+// once the given strong base (mol/L) is added to the raw water
+func (h *WaterTreatmentHandler) equilibriumPH(base float64) float32 {
+	target := float64(h.alkalinity)/alkalinityEquivalent + base
+
+	// the alkalinity grows with the pH, so bisect over the pH range
+	low, high := 0.0, 14.0
+	for i := 0; i < 50; i++ {
+		pH := (low + high) / 2
+		hydrogen := math.Pow(10, -pH)
+		alkalinity := h.carbonate*carbonateFactor(hydrogen) + waterKw/hydrogen - hydrogen
+		if alkalinity < target {
+			low = pH
+		} else {
+			high = pH
+		}
+	}
+	return float32((low + high) / 2)
+}
+
+func (h *WaterTreatmentHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	h.flow = h.nominalFlow * (0.95 + 0.1*rand.Float32())
+	if h.inflowLinked {
+		h.flow = max(0, h.inflow)
+	}
+	h.discreteInputs[treatmentNoFlowReg] = h.flow < treatmentMinFlow
+	log.Debugf("Water Treatment Flow: %v", h.flow)
+
+	chlorineRate := h.chlorinePumpCapacity * float32(h.chlorinePumpSpeed) / 1000
+	causticRate := h.causticPumpCapacity * float32(h.causticPumpSpeed) / 1000
+
+	// in auto mode the pumps dose proportionally to the flow: the pump rate
+	// carries the dose (mg/L) for every litre of water through the plant
+	if h.coils[treatmentAutoModeReg] {
+		chlorineRate = min(h.chlorinePumpCapacity, float32(h.chlorineDose)/100*h.flow/h.chlorineConcentration*3600/1000)
+		causticRate = min(h.causticPumpCapacity, float32(h.causticDose)*h.flow/h.causticConcentration*3600/1000)
+		h.chlorinePumpSpeed = uint16(math.Round(float64(chlorineRate / h.chlorinePumpCapacity * 1000)))
+		h.causticPumpSpeed = uint16(math.Round(float64(causticRate / h.causticPumpCapacity * 1000)))
+	}
+
+	h.chlorinePumpRate = 0
+	if h.coils[treatmentChlorinePumpReg] {
+		h.chlorinePumpRate = chlorineRate
+	}
+	h.causticPumpRate = 0
+	if h.coils[treatmentCausticPumpReg] {
+		h.causticPumpRate = causticRate
+	}
+	h.discreteInputs[treatmentChlorineRunningReg] = h.chlorinePumpRate > 0
+	h.discreteInputs[treatmentCausticRunningReg] = h.causticPumpRate > 0
+	log.Debugf("Water Treatment Chlorine Pump: %v L/h, Caustic Pump: %v L/h", h.chlorinePumpRate, h.causticPumpRate)
+
+	// mass balance of the contact tank over the one second tick, the treated
+	// water leaves at the tank concentration and is replaced by raw water
+	chlorineMass := h.chlorinePumpRate / 3600 * h.chlorineConcentration * 1000 // mg/s
+	causticMass := h.causticPumpRate / 3600 * h.causticConcentration * 1000    // mg/s
+	washout := h.flow / h.contactVolume                                        // 1/s
+	h.chlorine = stirredTank(h.chlorine, chlorineMass/h.contactVolume, washout+chlorineDecay)
+	h.caustic = stirredTank(h.caustic, causticMass/h.contactVolume, washout)
+
+	h.pH = h.equilibriumPH(float64(h.caustic) / causticMolarMass)
+	log.Debugf("Water Treatment Chlorine: %v mg/L, Caustic: %v mg/L, pH: %v", h.chlorine, h.caustic, h.pH)
+
+	h.discreteInputs[treatmentChlorineLowReg] = h.chlorine*100 < float32(h.chlorineLowAlarm)
+	h.discreteInputs[treatmentChlorineHighReg] = h.chlorine*100 > float32(h.chlorineHighAlarm)
+	h.discreteInputs[treatmentPHLowReg] = h.pH*100 < float32(h.pHLowAlarm)
+	h.discreteInputs[treatmentPHHighReg] = h.pH*100 > float32(h.pHHighAlarm)
+
+	return nil
+}
+
+func (h *WaterTreatmentHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *WaterTreatmentHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.discreteInputs) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		res = append(res, h.discreteInputs[int(req.Addr)+i])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *WaterTreatmentHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		// the dose setpoints are deliberately not limited, like the HMI of a
+		// poorly configured plant, so that unsafe doses can be commanded
+		switch regAddr {
+		case treatmentChlorineDoseReg:
+			if req.IsWrite {
+				h.chlorineDose = req.Args[i]
+			}
+			res = append(res, h.chlorineDose)
+
+		case treatmentCausticDoseReg:
+			if req.IsWrite {
+				h.causticDose = req.Args[i]
+			}
+			res = append(res, h.causticDose)
+
+		case treatmentChlorinePumpSpeedReg:
+			if req.IsWrite {
+				if req.Args[i] > 1000 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.chlorinePumpSpeed = req.Args[i]
+			}
+			res = append(res, h.chlorinePumpSpeed)
+
+		case treatmentCausticPumpSpeedReg:
+			if req.IsWrite {
+				if req.Args[i] > 1000 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.causticPumpSpeed = req.Args[i]
+			}
+			res = append(res, h.causticPumpSpeed)
+
+		case treatmentChlorineLowAlarmReg:
+			if req.IsWrite {
+				h.chlorineLowAlarm = req.Args[i]
+			}
+			res = append(res, h.chlorineLowAlarm)
+
+		case treatmentChlorineHighAlarmReg:
+			if req.IsWrite {
+				h.chlorineHighAlarm = req.Args[i]
+			}
+			res = append(res, h.chlorineHighAlarm)
+
+		case treatmentPHLowAlarmReg:
+			if req.IsWrite {
+				h.pHLowAlarm = req.Args[i]
+			}
+			res = append(res, h.pHLowAlarm)
+
+		case treatmentPHHighAlarmReg:
+			if req.IsWrite {
+				h.pHHighAlarm = req.Args[i]
+			}
+			res = append(res, h.pHHighAlarm)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *WaterTreatmentHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case treatmentFlowReg:
+			res = append(res, uint16((math.Float32bits(h.flow)>>16)&0xffff))
+		case treatmentFlowReg + 1:
+			res = append(res, uint16((math.Float32bits(h.flow))&0xffff))
+
+		case treatmentChlorineReg:
+			res = append(res, uint16((math.Float32bits(h.chlorine)>>16)&0xffff))
+		case treatmentChlorineReg + 1:
+			res = append(res, uint16((math.Float32bits(h.chlorine))&0xffff))
+
+		case treatmentPHReg:
+			res = append(res, uint16((math.Float32bits(h.pH)>>16)&0xffff))
+		case treatmentPHReg + 1:
+			res = append(res, uint16((math.Float32bits(h.pH))&0xffff))
+
+		case treatmentChlorinePumpRateReg:
+			res = append(res, uint16((math.Float32bits(h.chlorinePumpRate)>>16)&0xffff))
+		case treatmentChlorinePumpRateReg + 1:
+			res = append(res, uint16((math.Float32bits(h.chlorinePumpRate))&0xffff))
+
+		case treatmentCausticPumpRateReg:
+			res = append(res, uint16((math.Float32bits(h.causticPumpRate)>>16)&0xffff))
+		case treatmentCausticPumpRateReg + 1:
+			res = append(res, uint16((math.Float32bits(h.causticPumpRate))&0xffff))
+
+		case treatmentCausticReg:
+			res = append(res, uint16((math.Float32bits(h.caustic)>>16)&0xffff))
+		case treatmentCausticReg + 1:
+			res = append(res, uint16((math.Float32bits(h.caustic))&0xffff))
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
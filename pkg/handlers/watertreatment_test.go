@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"math"
+	"testing"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+)
+
+func TestStirredTank(t *testing.T) {
+	tests := []struct {
+		name          string
+		concentration float32
+		feed          float32
+		rate          float32
+		want          float32
+	}{
+		{"no loss", 1, 0.5, 0, 1.5},
+		{"steady state", 2, 1, 0.5, 2},
+		{"washout", 1, 0, 1, 0.367879},
+		{"chlorine decay", 1, 0, chlorineDecay, 0.999800},
+		{"fast rate without overshoot", 0, 4, 4, 0.981684},
+		{"very fast rate", 0, 10, 10, 0.999955},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stirredTank(tt.concentration, tt.feed, tt.rate)
+			if math.Abs(float64(got-tt.want)) > 1e-5 {
+				t.Errorf("stirredTank(%v, %v, %v) = %v, want %v", tt.concentration, tt.feed, tt.rate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEquilibriumPH(t *testing.T) {
+	tests := []struct {
+		name       string
+		rawPH      float32
+		alkalinity float32 // mg/L as CaCO3
+		base       float64 // mol/L
+		want       float32
+	}{
+		{"raw water", 7.2, 100, 0, 7.2},
+		{"raw water, low alkalinity", 8, 50, 0, 8},
+		{"pure water", 7, 0, 1e-4, 10},
+		{"pure water, more base", 7, 0, 1e-3, 11},
+		{"buffered", 7.2, 100, 1e-4, 7.408},
+		{"buffer exceeded", 7.2, 100, 1e-3, 9.919},
+		{"soft water", 6.5, 20, 2e-4, 7.203},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewWaterTreatmentHandler(config.WaterTreatment{
+				Flow:                  10,
+				ContactVolume:         50000,
+				RawPH:                 tt.rawPH,
+				Alkalinity:            tt.alkalinity,
+				ChlorineConcentration: 125000,
+				CausticConcentration:  250000,
+				ChlorinePumpCapacity:  10,
+				CausticPumpCapacity:   10,
+			})
+			if err := h.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if got := h.equilibriumPH(tt.base); math.Abs(float64(got-tt.want)) > 1e-3 {
+				t.Errorf("equilibriumPH(%v) = %v, want %v", tt.base, got, tt.want)
+			}
+		})
+	}
+}
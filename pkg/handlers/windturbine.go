@@ -0,0 +1,397 @@
+package handler
+
+/*
+* This file contains the handler for the wind turbine simulation.
+* The output of the turbine follows its power curve for the wind speed
+* reported by the weather source. The nacelle yaws into the wind, the
+* blades can be pitched, and the turbine shuts itself down in storms.
+ */
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/lopqto/icssimsuite/pkg/config"
+	"github.com/simonvetter/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Coils
+	windBrakeReg = 0
+
+	// Discrete Inputs (Read-Only)
+	windStormShutdownReg = 0
+	windBrakeEngagedReg  = 1
+	windGeneratingReg    = 2
+
+	// Holding Registers (Read/Write)
+	windPitchSetpointReg = 100 // tenths of a degree
+
+	// Input Registers (Read-Only)
+	windSpeedReg       = 100
+	windDirectionReg   = 102
+	windRotorRPMReg    = 104
+	windPowerReg       = 106
+	windYawReg         = 108
+	windPitchReg       = 110
+	windTotalEnergyReg = 112
+	windStateReg       = 200
+)
+
+// Turbine operating states
+const (
+	turbineStateStopped    = 0 // brake applied
+	turbineStateIdle       = 1 // waiting for wind
+	turbineStateGenerating = 2
+	turbineStateStorm      = 3 // storm shutdown, blades feathered
+)
+
+const (
+	// pitch actuator speed
+	pitchRate = 5 // degrees per second
+	// fully feathered blades
+	featherAngle = 90 // degrees
+	// yaw misalignment tolerated before the nacelle starts to turn
+	yawDeadband = 5 // degrees
+)
+
+type WindTurbineHandler struct {
+	Lock sync.RWMutex
+
+	coils          [10]bool
+	discreteInputs [10]bool
+
+	ratedPower   float32 // kW
+	cutInSpeed   float32 // m/s
+	ratedSpeed   float32 // m/s
+	cutOutSpeed  float32 // m/s
+	restartSpeed float32 // m/s
+	restartDelay uint16  // seconds
+	ratedRPM     float32
+	yawRate      float32 // degrees per second
+
+	pitchSetpoint uint16 // tenths of a degree
+
+	meanWindSpeed float32
+	windSpeed     float32
+	windDirection float32
+	gust          float32
+
+	state       uint16
+	calmCounter uint16
+	rotorRPM    float32
+	power       float32 // W
+	yaw         float32 // degrees
+	pitch       float32 // degrees
+	totalEnergy float64 // kWh
+}
+
+func NewWindTurbineHandler(config config.WindTurbine) *WindTurbineHandler {
+	return &WindTurbineHandler{
+		ratedPower:   config.RatedPower,
+		cutInSpeed:   config.CutInSpeed,
+		ratedSpeed:   config.RatedSpeed,
+		cutOutSpeed:  config.CutOutSpeed,
+		restartSpeed: config.RestartSpeed,
+		restartDelay: config.RestartDelay,
+		ratedRPM:     config.RatedRPM,
+		yawRate:      config.YawRate,
+	}
+}
+
+func (h *WindTurbineHandler) SetWindSpeed(windSpeed float32) {
+	h.Lock.Lock()
+	h.meanWindSpeed = windSpeed
+	h.Lock.Unlock()
+}
+
+func (h *WindTurbineHandler) SetWindDirection(windDirection float32) {
+	h.Lock.Lock()
+	h.windDirection = windDirection
+	h.Lock.Unlock()
+}
+
+// Power returns the power drawn by the turbine in W, negative when generating
+func (h *WindTurbineHandler) Power() float32 {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+	return -h.power
+}
+
+// Output returns the value of the named topology output
+func (h *WindTurbineHandler) Output(port string) (float32, bool) {
+	switch port {
+	case "power":
+		return h.Power(), true
+	}
+	return 0, false
+}
+
+func (h *WindTurbineHandler) Init() error {
+	// the power curve rises from the cut in to the rated speed, and the
+	// turbine leaves the storm shutdown below the restart speed
+	if h.ratedPower <= 0 {
+		return fmt.Errorf("wind turbine rated power must be positive")
+	}
+	if h.cutInSpeed < 0 || h.cutInSpeed >= h.ratedSpeed || h.ratedSpeed >= h.cutOutSpeed {
+		return fmt.Errorf("wind turbine speeds must be 0 <= cut in < rated < cut out")
+	}
+	if h.restartSpeed <= 0 || h.restartSpeed > h.cutOutSpeed {
+		return fmt.Errorf("wind turbine restart speed must be between 0 and the cut out speed")
+	}
+
+	h.meanWindSpeed = h.cutInSpeed * 2
+	h.windSpeed = h.meanWindSpeed
+	h.windDirection = 0
+	h.yaw = 0
+	h.pitch = 0
+	h.pitchSetpoint = 0
+	h.state = turbineStateIdle
+
+	h.coils[windBrakeReg] = false
+
+	return nil
+}
+
+// powerCurve returns the electrical power in W for the given wind speed
+func (h *WindTurbineHandler) powerCurve(v float32) float32 {
+	switch {
+	case v < h.cutInSpeed || v >= h.cutOutSpeed:
+		return 0
+	case v >= h.ratedSpeed:
+		return h.ratedPower * 1000
+	}
+
+	// the power in the wind grows with the cube of the wind speed
+	cube := func(x float32) float32 { return x * x * x }
+	return h.ratedPower * 1000 * (cube(v) - cube(h.cutInSpeed)) / (cube(h.ratedSpeed) - cube(h.cutInSpeed))
+}
+
+// angleDifference returns the signed difference between two headings, between -180 and 180 degrees
+func angleDifference(a, b float32) float32 {
+	d := math.Mod(float64(a-b)+540, 360) - 180
+	return float32(d)
+}
+
+func (h *WindTurbineHandler) Update() error {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	// the wind is gusty around the mean speed reported by the weather source
+	h.gust = 0.9*h.gust + 0.1*float32(rand.NormFloat64())*0.5*h.meanWindSpeed
+	h.windSpeed = max(0, h.meanWindSpeed+h.gust)
+	log.Debugf("Wind Speed: %v, Direction: %v", h.windSpeed, h.windDirection)
+
+	// update the state machine
+	switch h.state {
+	case turbineStateStorm:
+		// restart once the wind stayed below the restart speed long enough
+		if h.windSpeed < h.restartSpeed {
+			h.calmCounter++
+		} else {
+			h.calmCounter = 0
+		}
+		if h.calmCounter >= h.restartDelay {
+			log.Infof("Wind turbine: storm is over, restarting")
+			h.state = turbineStateIdle
+		}
+	default:
+		switch {
+		case h.windSpeed >= h.cutOutSpeed:
+			log.Infof("Wind turbine: storm shutdown at %v m/s", h.windSpeed)
+			h.state = turbineStateStorm
+			h.calmCounter = 0
+		case h.coils[windBrakeReg]:
+			h.state = turbineStateStopped
+		case h.windSpeed >= h.cutInSpeed:
+			h.state = turbineStateGenerating
+		default:
+			h.state = turbineStateIdle
+		}
+	}
+	log.Debugf("Turbine State: %v", h.state)
+
+	// blades are feathered during a storm, otherwise they follow the setpoint
+	pitchTarget := float32(h.pitchSetpoint) / 10
+	if h.state == turbineStateStorm || h.state == turbineStateStopped {
+		pitchTarget = featherAngle
+	}
+	h.pitch += max(-pitchRate, min(pitchRate, pitchTarget-h.pitch))
+
+	// the nacelle turns into the wind when the misalignment exceeds the deadband
+	misalignment := angleDifference(h.windDirection, h.yaw)
+	if misalignment > yawDeadband || misalignment < -yawDeadband {
+		h.yaw += max(-h.yawRate, min(h.yawRate, misalignment))
+		h.yaw = float32(math.Mod(float64(h.yaw)+360, 360))
+	}
+	log.Debugf("Yaw: %v, Misalignment: %v, Pitch: %v", h.yaw, misalignment, h.pitch)
+
+	// the rotor is held by the brake during a storm and when stopped,
+	// otherwise its speed follows the wind
+	targetRPM := h.ratedRPM * min(1, h.windSpeed/h.ratedSpeed)
+	targetRPM *= float32(math.Cos(float64(h.pitch) * math.Pi / 180))
+	braked := h.state == turbineStateStorm || h.state == turbineStateStopped
+	if braked {
+		targetRPM = 0
+		h.rotorRPM += (targetRPM - h.rotorRPM) / 3
+	} else {
+		h.rotorRPM += (targetRPM - h.rotorRPM) / 10
+	}
+
+	h.power = 0
+	if h.state == turbineStateGenerating {
+		yawFactor := float32(math.Cos(float64(misalignment) * math.Pi / 180))
+		pitchFactor := float32(math.Cos(float64(h.pitch) * math.Pi / 180))
+		h.power = h.powerCurve(h.windSpeed) * yawFactor * yawFactor * yawFactor * pitchFactor * pitchFactor
+		h.power = max(0, h.power)
+	}
+	log.Debugf("Rotor RPM: %v, Power: %v", h.rotorRPM, h.power)
+
+	// energy is integrated over the one second tick
+	h.totalEnergy += float64(h.power) / 1000 / 3600
+
+	h.discreteInputs[windStormShutdownReg] = h.state == turbineStateStorm
+	h.discreteInputs[windBrakeEngagedReg] = braked
+	h.discreteInputs[windGeneratingReg] = h.power > 0
+
+	return nil
+}
+
+func (h *WindTurbineHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.coils) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if i < len(req.Args) {
+			// only update the coils if the value is provided
+			h.coils[int(req.Addr)+i] = req.Args[i]
+		}
+		res = append(res, h.coils[int(req.Addr)+i])
+	}
+
+	log.Tracef("Coils: %v", res)
+
+	return res, nil
+}
+
+func (h *WindTurbineHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	if int(req.Addr)+int(req.Quantity) > len(h.discreteInputs) {
+		err = modbus.ErrIllegalDataAddress
+		log.Warnf("Illegal data address: %v", req.Addr)
+		return
+	}
+
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		res = append(res, h.discreteInputs[int(req.Addr)+i])
+	}
+
+	log.Tracef("Discrete Inputs: %v", res)
+
+	return res, nil
+}
+
+func (h *WindTurbineHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	var regAddr uint16
+
+	h.Lock.Lock()
+	// release the lock upon return
+	defer h.Lock.Unlock()
+
+	for i := 0; i < int(req.Quantity); i++ {
+		regAddr = req.Addr + uint16(i)
+
+		switch regAddr {
+		case windPitchSetpointReg:
+			if req.IsWrite {
+				if req.Args[i] > featherAngle*10 {
+					err = modbus.ErrIllegalDataValue
+					log.Warnf("Illegal data value: %v", req.Args[i])
+					return
+				}
+				h.pitchSetpoint = req.Args[i]
+			}
+			res = append(res, h.pitchSetpoint)
+
+		default:
+			err = modbus.ErrIllegalDataAddress
+			log.Warnf("Illegal data address: %v", regAddr)
+			return
+		}
+	}
+
+	log.Tracef("Holding Registers: %v", res)
+
+	return res, nil
+}
+
+func (h *WindTurbineHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	totalEnergy := float32(h.totalEnergy)
+
+	for regAddr := req.Addr; regAddr < req.Addr+req.Quantity; regAddr++ {
+		switch regAddr {
+
+		case windSpeedReg:
+			res = append(res, uint16((math.Float32bits(h.windSpeed)>>16)&0xffff))
+		case windSpeedReg + 1:
+			res = append(res, uint16((math.Float32bits(h.windSpeed))&0xffff))
+
+		case windDirectionReg:
+			res = append(res, uint16((math.Float32bits(h.windDirection)>>16)&0xffff))
+		case windDirectionReg + 1:
+			res = append(res, uint16((math.Float32bits(h.windDirection))&0xffff))
+
+		case windRotorRPMReg:
+			res = append(res, uint16((math.Float32bits(h.rotorRPM)>>16)&0xffff))
+		case windRotorRPMReg + 1:
+			res = append(res, uint16((math.Float32bits(h.rotorRPM))&0xffff))
+
+		case windPowerReg:
+			res = append(res, uint16((math.Float32bits(h.power)>>16)&0xffff))
+		case windPowerReg + 1:
+			res = append(res, uint16((math.Float32bits(h.power))&0xffff))
+
+		case windYawReg:
+			res = append(res, uint16((math.Float32bits(h.yaw)>>16)&0xffff))
+		case windYawReg + 1:
+			res = append(res, uint16((math.Float32bits(h.yaw))&0xffff))
+
+		case windPitchReg:
+			res = append(res, uint16((math.Float32bits(h.pitch)>>16)&0xffff))
+		case windPitchReg + 1:
+			res = append(res, uint16((math.Float32bits(h.pitch))&0xffff))
+
+		case windTotalEnergyReg:
+			res = append(res, uint16((math.Float32bits(totalEnergy)>>16)&0xffff))
+		case windTotalEnergyReg + 1:
+			res = append(res, uint16((math.Float32bits(totalEnergy))&0xffff))
+
+		case windStateReg:
+			res = append(res, h.state)
+
+		default:
+			log.Warnf("Illegal data address: %v", regAddr)
+			err = modbus.ErrIllegalDataAddress
+			return
+		}
+	}
+
+	log.Tracef("Input Registers: %v", res)
+
+	return res, nil
+}
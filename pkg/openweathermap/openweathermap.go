@@ -8,8 +8,11 @@ import (
 )
 
 type Weather struct {
-	Temperature float32
-	Humidity    float32
+	Temperature   float32
+	Humidity      float32
+	CloudCover    float32
+	WindSpeed     float32
+	WindDirection float32
 
 	apiKey string
 	city   string
@@ -28,9 +31,22 @@ func (w *Weather) GetCurrentWeather() (Weather, error) {
 		log.Errorf("Error: %v", err)
 		return Weather{}, err
 	}
-	owmcli.CurrentByName(w.city)
+	err = owmcli.CurrentByName(w.city)
+	if err != nil {
+		log.Errorf("Error: %v", err)
+		return Weather{}, err
+	}
 	humidity := float32(owmcli.Main.Humidity)
 	temperature := float32(owmcli.Main.Temp)
-	log.Infof("Temperature: %v, Humidity: %v", temperature, humidity)
-	return Weather{Temperature: temperature, Humidity: humidity}, nil
+	cloudCover := float32(owmcli.Clouds.All)
+	windSpeed := float32(owmcli.Wind.Speed)
+	windDirection := float32(owmcli.Wind.Deg)
+	log.Infof("Temperature: %v, Humidity: %v, Cloud Cover: %v, Wind: %v m/s %v deg", temperature, humidity, cloudCover, windSpeed, windDirection)
+	return Weather{
+		Temperature:   temperature,
+		Humidity:      humidity,
+		CloudCover:    cloudCover,
+		WindSpeed:     windSpeed,
+		WindDirection: windDirection,
+	}, nil
 }
@@ -0,0 +1,400 @@
+package sunspec
+
+/*
+* This package encodes SunSpec information models, so energy devices can be
+* presented to off-the-shelf SunSpec clients. A device map starts with the
+* 'SunS' marker at the base address, followed by the common model, the
+* device models and the end model.
+*
+* Values are encoded with scale factors: a point is reported as an integer
+* together with a power of ten exponent (the _SF points), which is picked
+* for each update so the values keep the best possible resolution.
+ */
+
+import (
+	"math"
+)
+
+// BaseAddress is the register address of the 'SunS' marker
+const BaseAddress = 40000
+
+// Model IDs
+const (
+	CommonModelId              = 1
+	SinglePhaseInverterModelId = 101
+	ThreePhaseInverterModelId  = 103
+	SinglePhaseMeterModelId    = 201
+	ThreePhaseMeterModelId     = 203
+	EndModelId                 = 0xffff
+)
+
+// Model lengths, not counting the two header registers
+const (
+	commonModelLength   = 66
+	inverterModelLength = 50
+	meterModelLength    = 105
+)
+
+// Values reported for points a device does not implement
+const (
+	notImplementedUint16 = 0xffff
+	notImplementedInt16  = 0x8000
+	notImplementedAcc32  = 0
+)
+
+// the 'SunS' marker
+var marker = []uint16{0x5375, 0x6e53}
+
+// Common holds the points of the common model (1)
+type Common struct {
+	Manufacturer  string
+	Model         string
+	Options       string
+	Version       string
+	SerialNumber  string
+	DeviceAddress uint16
+}
+
+// Inverter holds the points of the inverter models (101 and 103)
+type Inverter struct {
+	// Phases selects the single phase (1) or three phase (3) model
+	Phases int
+
+	Current            float64    // A, total
+	PhaseCurrent       [3]float64 // A
+	PhaseVoltage       [3]float64 // V, line to neutral
+	LineVoltage        [3]float64 // V, line to line (AB, BC, CA)
+	Power              float64    // W
+	Frequency          float64    // Hz
+	ApparentPower      float64    // VA
+	ReactivePower      float64    // var
+	PowerFactor        float64    // %
+	Energy             float64    // Wh, lifetime
+	DCCurrent          float64    // A
+	DCVoltage          float64    // V
+	DCPower            float64    // W
+	CabinetTemperature float64    // Celsius
+	State              uint16
+	Events             uint32
+}
+
+// Meter holds the points of the meter models (201 and 203)
+type Meter struct {
+	// Phases selects the single phase (1) or three phase wye (3) model
+	Phases int
+
+	Current             float64    // A, total
+	PhaseCurrent        [3]float64 // A
+	Voltage             float64    // V, average line to neutral
+	PhaseVoltage        [3]float64 // V, line to neutral
+	LineVoltage         [3]float64 // V, line to line (AB, BC, CA)
+	Frequency           float64    // Hz
+	Power               float64    // W, total
+	PhasePower          [3]float64 // W
+	ApparentPower       float64    // VA, total
+	PhaseApparentPower  [3]float64 // VA
+	ReactivePower       float64    // var, total
+	PhaseReactivePower  [3]float64 // var
+	PowerFactor         float64    // %, average
+	PhasePowerFactor    [3]float64 // %
+	ExportedEnergy      float64    // Wh, total
+	PhaseExportedEnergy [3]float64 // Wh
+	ImportedEnergy      float64    // Wh, total
+	PhaseImportedEnergy [3]float64 // Wh
+	Events              uint32
+}
+
+// Map is the register image of a SunSpec device, starting at BaseAddress
+type Map []uint16
+
+// NewMap lays out the given models after the 'SunS' marker and closes the map with the end model
+func NewMap(models ...[]uint16) Map {
+	m := Map{}
+	m = append(m, marker...)
+	for _, model := range models {
+		m = append(m, model...)
+	}
+	return append(m, EndModelId, 0)
+}
+
+// Read returns quantity registers starting at the given address,
+// or false if the range is not covered by the map
+func (m Map) Read(addr uint16, quantity uint16) ([]uint16, bool) {
+	if addr < BaseAddress || int(addr-BaseAddress)+int(quantity) > len(m) {
+		return nil, false
+	}
+	offset := addr - BaseAddress
+	return m[offset : offset+quantity], true
+}
+
+// Contains reports whether the address belongs to the map
+func (m Map) Contains(addr uint16) bool {
+	return addr >= BaseAddress && int(addr-BaseAddress) < len(m)
+}
+
+// CommonModel encodes the common model (1)
+func CommonModel(c Common) []uint16 {
+	w := &writer{}
+	w.uint16(CommonModelId)
+	w.uint16(commonModelLength)
+	w.string(c.Manufacturer, 16)
+	w.string(c.Model, 16)
+	w.string(c.Options, 8)
+	w.string(c.Version, 8)
+	w.string(c.SerialNumber, 16)
+	w.uint16(c.DeviceAddress)
+	// pad
+	w.uint16(notImplementedUint16)
+	return w.regs
+}
+
+// InverterModel encodes the single phase (101) or three phase (103) inverter model
+func InverterModel(v Inverter) []uint16 {
+	w := &writer{}
+	if v.Phases == 3 {
+		w.uint16(ThreePhaseInverterModelId)
+	} else {
+		w.uint16(SinglePhaseInverterModelId)
+	}
+	w.uint16(inverterModelLength)
+
+	// AC current
+	sf := unsignedScaleFactor(v.Current, v.PhaseCurrent[0], v.PhaseCurrent[1], v.PhaseCurrent[2])
+	w.scaledUint16(v.Current, sf)
+	w.phasesUint16(v.Phases, v.PhaseCurrent, sf)
+	w.int16(sf)
+
+	// AC voltage, a single phase device has no line to line voltage
+	sf = unsignedScaleFactor(v.PhaseVoltage[0], v.PhaseVoltage[1], v.PhaseVoltage[2],
+		v.LineVoltage[0], v.LineVoltage[1], v.LineVoltage[2])
+	w.phasesUint16(linePhases(v.Phases), v.LineVoltage, sf)
+	w.phasesUint16(v.Phases, v.PhaseVoltage, sf)
+	w.int16(sf)
+
+	w.scaledInt16WithFactor(v.Power)
+	w.scaledUint16WithFactor(v.Frequency)
+	w.scaledInt16WithFactor(v.ApparentPower)
+	w.scaledInt16WithFactor(v.ReactivePower)
+	w.scaledInt16WithFactor(v.PowerFactor)
+
+	// lifetime energy
+	w.acc32(uint32(v.Energy))
+	w.int16(0)
+
+	w.scaledUint16WithFactor(v.DCCurrent)
+	w.scaledUint16WithFactor(v.DCVoltage)
+	w.scaledInt16WithFactor(v.DCPower)
+
+	// temperatures: cabinet, heat sink, transformer, other
+	sf = signedScaleFactor(v.CabinetTemperature)
+	w.scaledInt16(v.CabinetTemperature, sf)
+	w.uint16(notImplementedInt16)
+	w.uint16(notImplementedInt16)
+	w.uint16(notImplementedInt16)
+	w.int16(sf)
+
+	// operating state and vendor state
+	w.uint16(v.State)
+	w.uint16(notImplementedUint16)
+
+	// events, events 2 and the four vendor event registers
+	w.uint32(v.Events)
+	for i := 0; i < 5; i++ {
+		w.uint32(0)
+	}
+
+	return w.regs
+}
+
+// MeterModel encodes the single phase (201) or three phase wye (203) meter model
+func MeterModel(v Meter) []uint16 {
+	w := &writer{}
+	if v.Phases == 3 {
+		w.uint16(ThreePhaseMeterModelId)
+	} else {
+		w.uint16(SinglePhaseMeterModelId)
+	}
+	w.uint16(meterModelLength)
+
+	// current
+	sf := signedScaleFactor(v.Current, v.PhaseCurrent[0], v.PhaseCurrent[1], v.PhaseCurrent[2])
+	w.scaledInt16(v.Current, sf)
+	w.phasesInt16(v.Phases, v.PhaseCurrent, sf)
+	w.int16(sf)
+
+	// voltage
+	lineVoltage := 0.0
+	if v.Phases == 3 {
+		lineVoltage = (v.LineVoltage[0] + v.LineVoltage[1] + v.LineVoltage[2]) / 3
+	}
+	sf = signedScaleFactor(v.Voltage, v.PhaseVoltage[0], v.PhaseVoltage[1], v.PhaseVoltage[2],
+		v.LineVoltage[0], v.LineVoltage[1], v.LineVoltage[2])
+	w.scaledInt16(v.Voltage, sf)
+	w.phasesInt16(v.Phases, v.PhaseVoltage, sf)
+	if v.Phases == 3 {
+		w.scaledInt16(lineVoltage, sf)
+	} else {
+		w.uint16(notImplementedInt16)
+	}
+	w.phasesInt16(linePhases(v.Phases), v.LineVoltage, sf)
+	w.int16(sf)
+
+	w.scaledInt16WithFactor(v.Frequency)
+
+	for _, point := range []struct {
+		total  float64
+		phases [3]float64
+	}{
+		{v.Power, v.PhasePower},
+		{v.ApparentPower, v.PhaseApparentPower},
+		{v.ReactivePower, v.PhaseReactivePower},
+		{v.PowerFactor, v.PhasePowerFactor},
+	} {
+		sf = signedScaleFactor(point.total, point.phases[0], point.phases[1], point.phases[2])
+		w.scaledInt16(point.total, sf)
+		w.phasesInt16(v.Phases, point.phases, sf)
+		w.int16(sf)
+	}
+
+	// real energy, exported then imported
+	w.acc32(uint32(v.ExportedEnergy))
+	w.phasesAcc32(v.Phases, v.PhaseExportedEnergy)
+	w.acc32(uint32(v.ImportedEnergy))
+	w.phasesAcc32(v.Phases, v.PhaseImportedEnergy)
+	w.int16(0)
+
+	// apparent energy, exported then imported, is not metered
+	for i := 0; i < 8; i++ {
+		w.acc32(notImplementedAcc32)
+	}
+	w.uint16(notImplementedInt16)
+
+	// reactive energy for the four quadrants is not metered
+	for i := 0; i < 16; i++ {
+		w.acc32(notImplementedAcc32)
+	}
+	w.uint16(notImplementedInt16)
+
+	w.uint32(v.Events)
+
+	return w.regs
+}
+
+// linePhases returns the number of line to line voltages a device measures
+func linePhases(phases int) int {
+	if phases == 3 {
+		return 3
+	}
+	return 0
+}
+
+// signedScaleFactor returns the scale factor giving the best resolution
+// for the values while keeping them within an int16
+func signedScaleFactor(values ...float64) int16 {
+	return scaleFactor(math.MaxInt16, values...)
+}
+
+// unsignedScaleFactor returns the scale factor giving the best resolution
+// for the values while keeping them within an uint16
+func unsignedScaleFactor(values ...float64) int16 {
+	// 0xffff is reserved for points that are not implemented
+	return scaleFactor(math.MaxUint16-1, values...)
+}
+
+func scaleFactor(limit float64, values ...float64) int16 {
+	largest := 0.0
+	for _, v := range values {
+		largest = max(largest, math.Abs(v))
+	}
+
+	for sf := -3; sf < 10; sf++ {
+		if largest/math.Pow10(sf) <= limit {
+			return int16(sf)
+		}
+	}
+	return 10
+}
+
+// writer appends SunSpec points to a register block
+type writer struct {
+	regs []uint16
+}
+
+func (w *writer) uint16(v uint16) {
+	w.regs = append(w.regs, v)
+}
+
+func (w *writer) int16(v int16) {
+	w.regs = append(w.regs, uint16(v))
+}
+
+func (w *writer) uint32(v uint32) {
+	w.regs = append(w.regs, uint16((v>>16)&0xffff), uint16(v&0xffff))
+}
+
+func (w *writer) acc32(v uint32) {
+	w.uint32(v)
+}
+
+// string writes a null padded string over the given number of registers
+func (w *writer) string(s string, registers int) {
+	b := make([]byte, registers*2)
+	copy(b, s)
+	for i := 0; i < registers; i++ {
+		w.regs = append(w.regs, uint16(b[2*i])<<8|uint16(b[2*i+1]))
+	}
+}
+
+func (w *writer) scaledUint16(v float64, sf int16) {
+	w.uint16(uint16(math.Round(max(0, v) / math.Pow10(int(sf)))))
+}
+
+func (w *writer) scaledInt16(v float64, sf int16) {
+	w.int16(int16(math.Round(v / math.Pow10(int(sf)))))
+}
+
+// scaledUint16WithFactor writes a single value followed by its own scale factor
+func (w *writer) scaledUint16WithFactor(v float64) {
+	sf := unsignedScaleFactor(v)
+	w.scaledUint16(v, sf)
+	w.int16(sf)
+}
+
+// scaledInt16WithFactor writes a single value followed by its own scale factor
+func (w *writer) scaledInt16WithFactor(v float64) {
+	sf := signedScaleFactor(v)
+	w.scaledInt16(v, sf)
+	w.int16(sf)
+}
+
+// phasesUint16 writes the three phase values, marking the phases
+// a single phase device does not have as not implemented
+func (w *writer) phasesUint16(phases int, values [3]float64, sf int16) {
+	for i, v := range values {
+		if i >= phases {
+			w.uint16(notImplementedUint16)
+			continue
+		}
+		w.scaledUint16(v, sf)
+	}
+}
+
+func (w *writer) phasesInt16(phases int, values [3]float64, sf int16) {
+	for i, v := range values {
+		if i >= phases {
+			w.uint16(notImplementedInt16)
+			continue
+		}
+		w.scaledInt16(v, sf)
+	}
+}
+
+func (w *writer) phasesAcc32(phases int, values [3]float64) {
+	for i, v := range values {
+		if i >= phases {
+			w.acc32(notImplementedAcc32)
+			continue
+		}
+		w.acc32(uint32(v))
+	}
+}